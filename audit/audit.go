@@ -0,0 +1,218 @@
+// Package audit records who accessed which files and blocks, in an
+// append-only log of JSON lines rotated by size.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	upspinerrors "upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// The access decisions of the entries.
+const (
+	Allowed = "allowed"
+	Denied  = "denied"
+	Failed  = "failed"
+)
+
+// Entry is a record of the log.
+type Entry struct {
+	Time     time.Time        `json:"time"`
+	User     upspin.UserName  `json:"user"`
+	Op       string           `json:"op"`
+	Path     upspin.PathName  `json:"path,omitempty"`
+	Ref      upspin.Reference `json:"ref,omitempty"`
+	Bytes    int              `json:"bytes"`
+	Decision string           `json:"decision"`
+	Error    string           `json:"error,omitempty"`
+}
+
+// Decision returns the access decision of a call that returned err.
+func Decision(err error) string {
+	switch {
+	case err == nil || err == upspin.ErrFollowLink:
+		return Allowed
+	case upspinerrors.Is(upspinerrors.Private, err) || upspinerrors.Is(upspinerrors.Permission, err):
+		return Denied
+	}
+	return Failed
+}
+
+// Log appends entries to the file Name. Once the file holds more than
+// MaxSize bytes, it is renamed Name.1, the previous Name.1 is renamed
+// Name.2 and so on, keeping at most MaxFiles rotated files.
+type Log struct {
+	Name     string
+	MaxSize  int64
+	MaxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Record appends e to the log.
+func (l *Log) Record(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "could not encode audit entry")
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	if l.MaxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.MaxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return errors.Wrapf(err, "could not write audit log %q", l.Name)
+	}
+
+	return nil
+}
+
+// Close closes the file of the log.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.Name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "could not open audit log %q", l.Name)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "could not stat audit log %q", l.Name)
+	}
+
+	l.file, l.size = f, fi.Size()
+	return nil
+}
+
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return errors.Wrapf(err, "could not close audit log %q", l.Name)
+	}
+	l.file = nil
+
+	if l.MaxFiles > 0 {
+		os.Remove(rotated(l.Name, l.MaxFiles))
+		for i := l.MaxFiles - 1; i > 0; i-- {
+			os.Rename(rotated(l.Name, i), rotated(l.Name, i+1))
+		}
+		if err := os.Rename(l.Name, rotated(l.Name, 1)); err != nil {
+			return errors.Wrapf(err, "could not rotate audit log %q", l.Name)
+		}
+	} else if err := os.Remove(l.Name); err != nil {
+		return errors.Wrapf(err, "could not rotate audit log %q", l.Name)
+	}
+
+	return l.open()
+}
+
+func rotated(name string, i int) string {
+	return fmt.Sprintf("%s.%d", name, i)
+}
+
+// Filter selects entries. The zero values match everything.
+type Filter struct {
+	User       upspin.UserName
+	PathPrefix string
+	Since      time.Time
+	Until      time.Time
+}
+
+// Match reports whether e is selected by f. The path prefix is matched
+// against the path and the block reference of e.
+func (f Filter) Match(e Entry) bool {
+	if f.User != "" && e.User != f.User {
+		return false
+	}
+	if f.PathPrefix != "" &&
+		!strings.HasPrefix(string(e.Path), f.PathPrefix) &&
+		!strings.HasPrefix(string(e.Ref), f.PathPrefix) {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Query returns the entries of the log name and of its rotated files
+// matched by f, from the oldest to the newest.
+func Query(name string, f Filter) ([]Entry, error) {
+	names := []string{}
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotated(name, i)); err != nil {
+			break
+		}
+		names = append([]string{rotated(name, i)}, names...)
+	}
+	names = append(names, name)
+
+	entries := []Entry{}
+	for _, n := range names {
+		file, err := os.Open(n)
+		if os.IsNotExist(err) && n != name {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not open audit log %q", n)
+		}
+
+		scanner := bufio.NewScanner(file)
+		for line := 1; scanner.Scan(); line++ {
+			var e Entry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				file.Close()
+				return nil, errors.Wrapf(err, "%s:%d: invalid entry", n, line)
+			}
+			if f.Match(e) {
+				entries = append(entries, e)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read audit log %q", n)
+		}
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,120 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+func TestRecordAndQuery(t *testing.T) {
+	l := &Log{Name: filepath.Join(t.TempDir(), "audit.log")}
+
+	t0 := time.Date(2017, 11, 1, 12, 0, 0, 0, time.UTC)
+	entries := []Entry{
+		{Time: t0, User: "a@example.com", Op: "dir.Lookup", Path: "owner@example.com/docs/a.txt", Decision: Allowed},
+		{Time: t0.Add(time.Minute), User: "b@example.com", Op: "store.Get", Ref: "/docs/a.txt-0", Bytes: 12, Decision: Allowed},
+		{Time: t0.Add(2 * time.Minute), User: "a@example.com", Op: "dir.Lookup", Path: "owner@example.com/private/b.txt", Decision: Denied, Error: "private"},
+	}
+	for _, e := range entries {
+		require.NoError(t, l.Record(e))
+	}
+	require.NoError(t, l.Close())
+
+	all, err := Query(l.Name, Filter{})
+	require.NoError(t, err)
+	assert.Len(t, all, 3)
+	assert.True(t, all[0].Time.Equal(t0))
+	all[0].Time = t0
+	assert.Equal(t, entries[0], all[0])
+
+	byUser, err := Query(l.Name, Filter{User: "a@example.com"})
+	require.NoError(t, err)
+	assert.Len(t, byUser, 2)
+
+	byPath, err := Query(l.Name, Filter{PathPrefix: "owner@example.com/docs/"})
+	require.NoError(t, err)
+	require.Len(t, byPath, 1)
+	assert.Equal(t, upspin.PathName("owner@example.com/docs/a.txt"), byPath[0].Path)
+
+	byRef, err := Query(l.Name, Filter{PathPrefix: "/docs/"})
+	require.NoError(t, err)
+	require.Len(t, byRef, 1)
+	assert.Equal(t, 12, byRef[0].Bytes)
+
+	byTime, err := Query(l.Name, Filter{Since: t0.Add(time.Minute), Until: t0.Add(2 * time.Minute)})
+	require.NoError(t, err)
+	require.Len(t, byTime, 1)
+	assert.Equal(t, upspin.UserName("b@example.com"), byTime[0].User)
+}
+
+func TestRecordAppends(t *testing.T) {
+	l := &Log{Name: filepath.Join(t.TempDir(), "audit.log")}
+
+	require.NoError(t, l.Record(Entry{User: "a@example.com", Op: "dir.Lookup"}))
+	require.NoError(t, l.Close())
+
+	reopened := &Log{Name: l.Name}
+	require.NoError(t, reopened.Record(Entry{User: "b@example.com", Op: "dir.Lookup"}))
+	require.NoError(t, reopened.Close())
+
+	entries, err := Query(l.Name, Filter{})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, upspin.UserName("a@example.com"), entries[0].User)
+	assert.Equal(t, upspin.UserName("b@example.com"), entries[1].User)
+	assert.False(t, entries[0].Time.IsZero())
+}
+
+func TestRotation(t *testing.T) {
+	l := &Log{
+		Name:     filepath.Join(t.TempDir(), "audit.log"),
+		MaxSize:  200,
+		MaxFiles: 2,
+	}
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, l.Record(Entry{
+			Time: time.Unix(int64(i), 0).UTC(),
+			User: "a@example.com",
+			Op:   "store.Get",
+			Ref:  "/file-0",
+		}))
+	}
+	require.NoError(t, l.Close())
+
+	for _, name := range []string{l.Name, l.Name + ".1", l.Name + ".2"} {
+		fi, err := os.Stat(name)
+		require.NoError(t, err)
+		assert.True(t, fi.Size() <= 200, "%s holds %d bytes", name, fi.Size())
+	}
+	_, err := os.Stat(l.Name + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	entries, err := Query(l.Name, Filter{})
+	require.NoError(t, err)
+	require.NotEmpty(t, entries)
+	assert.True(t, len(entries) < 10, "the oldest entries are dropped")
+	for i := 1; i < len(entries); i++ {
+		assert.True(t, entries[i-1].Time.Before(entries[i].Time), "entries are in order")
+	}
+	assert.Equal(t, int64(9), entries[len(entries)-1].Time.Unix())
+}
+
+func TestQueryMissingLog(t *testing.T) {
+	_, err := Query("/nonexistent/audit.log", Filter{})
+	assert.Error(t, err)
+}
+
+func TestDecision(t *testing.T) {
+	assert.Equal(t, Allowed, Decision(nil))
+	assert.Equal(t, Allowed, Decision(upspin.ErrFollowLink))
+	assert.Equal(t, Denied, Decision(errors.E(errors.Private)))
+	assert.Equal(t, Denied, Decision(errors.E(errors.Permission)))
+	assert.Equal(t, Failed, Decision(errors.E(errors.NotExist)))
+}
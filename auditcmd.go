@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/gildasch/upspin-localserver/audit"
+	"github.com/pkg/errors"
+	"upspin.io/upspin"
+)
+
+// queryAudit prints the entries of the audit log matching the filters.
+func queryAudit(args []string) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	logPtr := fs.String("log", "",
+		"the audit log of the server, as given to -audit-log")
+	userPtr := fs.String("user", "",
+		"if set, only show the accesses of this user")
+	pathPtr := fs.String("path", "",
+		"if set, only show the accesses to the paths and blocks starting with this prefix")
+	sincePtr := fs.String("since", "",
+		"if set, only show the accesses from this time, as RFC 3339 or a duration ago such as 24h")
+	untilPtr := fs.String("until", "",
+		"if set, only show the accesses before this time, as RFC 3339 or a duration ago")
+	fs.Parse(args)
+
+	if *logPtr == "" {
+		fmt.Fprintln(os.Stderr, "-log must be set")
+		os.Exit(2)
+	}
+
+	now := time.Now()
+	since, err := parseTime(*sincePtr, now)
+	if err == nil {
+		var until time.Time
+		until, err = parseTime(*untilPtr, now)
+		if err == nil {
+			err = printAudit(os.Stdout, *logPtr, audit.Filter{
+				User:       upspin.UserName(*userPtr),
+				PathPrefix: *pathPtr,
+				Since:      since,
+				Until:      until,
+			})
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not query the audit log: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func printAudit(w io.Writer, name string, f audit.Filter) error {
+	entries, err := audit.Query(name, f)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		target := string(e.Path)
+		if e.Ref != "" {
+			target = string(e.Ref)
+		}
+		fmt.Fprintf(w, "%s %s %s %s %d %s\n",
+			e.Time.Format(time.RFC3339), e.User, e.Op, target, e.Bytes, e.Decision)
+	}
+
+	return nil
+}
+
+// parseTime parses s as an RFC 3339 time or as a duration before now.
+// An empty s is the zero time.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, errors.Errorf("invalid time %q: neither RFC 3339 nor a duration", s)
+	}
+	return now.Add(-d), nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gildasch/upspin-localserver/audit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrintAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	l := &audit.Log{Name: filepath.Join(dir, "audit.log")}
+	t0 := time.Date(2017, 11, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, l.Record(audit.Entry{Time: t0, User: "a@example.com", Op: "dir.Lookup", Path: "o@example.com/a.txt", Decision: audit.Allowed}))
+	require.NoError(t, l.Record(audit.Entry{Time: t0, User: "b@example.com", Op: "store.Get", Ref: "/a.txt-0", Bytes: 5, Decision: audit.Denied}))
+	require.NoError(t, l.Close())
+
+	var buf bytes.Buffer
+	require.NoError(t, printAudit(&buf, l.Name, audit.Filter{}))
+	assert.Equal(t, `2017-11-01T12:00:00Z a@example.com dir.Lookup o@example.com/a.txt 0 allowed
+2017-11-01T12:00:00Z b@example.com store.Get /a.txt-0 5 denied
+`, buf.String())
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2017, 11, 2, 0, 0, 0, 0, time.UTC)
+
+	zero, err := parseTime("", now)
+	require.NoError(t, err)
+	assert.True(t, zero.IsZero())
+
+	abs, err := parseTime("2017-11-01T12:00:00Z", now)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2017, 11, 1, 12, 0, 0, 0, time.UTC), abs)
+
+	ago, err := parseTime("24h", now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(-24*time.Hour), ago)
+
+	_, err = parseTime("yesterday", now)
+	assert.Error(t, err)
+}
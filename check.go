@@ -0,0 +1,156 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gildasch/upspin-localserver/local"
+	"github.com/gildasch/upspin-localserver/packing"
+	"github.com/pkg/errors"
+	"upspin.io/pack"
+	_ "upspin.io/pack/plain"
+	"upspin.io/upspin"
+	"upspin.io/valid"
+)
+
+// check validates the configuration, the keys and the tree the server
+// would serve with the same flags, and exits non-zero on problems.
+func check(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	configPtr := fs.String("config", "",
+		"the upspin config file of the server user")
+	rootPtr := fs.String("root", ".",
+		"the root directory to serve")
+	upperPtr := fs.String("upper", "",
+		"if set, a writable directory overlaid on top of the read-only root")
+	ignorePtr := fs.String("ignore", "",
+		"a file of gitignore-style rules hiding files of the whole tree")
+	hideDotfilesPtr := fs.Bool("hide-dotfiles", false,
+		"hide the files and directories starting with a dot")
+	keyPtr := fs.String("encryption-key", "",
+		"if set, a file holding the hex-encoded AES-256 key the files of the upper directory are encrypted with; the root is served as it is")
+	fs.Parse(args)
+
+	cfg, err := newConfig(*configPtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not load the config: %v\n", err)
+		os.Exit(1)
+	}
+
+	storage, err := newStorage(*rootPtr, *upperPtr, *keyPtr, *ignorePtr, *hideDotfilesPtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not open the root: %v\n", err)
+		os.Exit(1)
+	}
+
+	problems := checkConfig(cfg)
+	problems = append(problems, checkTree(storage, string(cfg.UserName()))...)
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "%d problem(s) found\n", len(problems))
+		os.Exit(1)
+	}
+
+	fmt.Println("OK")
+}
+
+// checkConfig verifies that the factotum of cfg signs entries that
+// clients can verify with the key registered for the user.
+func checkConfig(cfg upspin.Config) []string {
+	if err := valid.UserName(cfg.UserName()); err != nil {
+		return []string{fmt.Sprintf("config: invalid user name: %v", err)}
+	}
+	if cfg.Factotum() == nil {
+		return []string{"config: no keys loaded"}
+	}
+
+	fi := local.FileInfo{Filename: "/check", Dir: "/", Time: time.Now()}
+	de, err := packing.Plain{}.DirEntry(string(cfg.UserName()), fi, cfg.Factotum())
+	if err != nil {
+		return []string{fmt.Sprintf("keys: could not sign entries: %v", err)}
+	}
+
+	packer := pack.Lookup(upspin.PlainPack)
+	if packer == nil {
+		return []string{"keys: plain packing is not registered"}
+	}
+	if _, err := packer.Unpack(cfg, de); err != nil {
+		return []string{fmt.Sprintf("keys: signed entries do not unpack: %v", err)}
+	}
+
+	return nil
+}
+
+// checkTree walks files and returns the files that are unreadable, the
+// broken symbolic links and the names upspin can't represent.
+func checkTree(files local.Files, username string) []string {
+	problems := []string{}
+
+	var walk func(dir string)
+	walk = func(dir string) {
+		fis, err := files.List(dir)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: unreadable directory: %v", dir, errors.Cause(err)))
+			return
+		}
+
+		for _, fi := range fis {
+			name := path.Join(dir, path.Base(fi.Filename))
+
+			if !utf8.ValidString(name) {
+				problems = append(problems, fmt.Sprintf("%q: name is not valid UTF-8", name))
+				continue
+			}
+			if err := valid.Pathname(upspin.PathName(username + name)); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: invalid upspin name: %v", name, err))
+				continue
+			}
+
+			if fi.Link != "" {
+				target, err := files.Stat(name)
+				if err != nil {
+					problems = append(problems, fmt.Sprintf("%s: broken symbolic link to %s", name, fi.Link))
+					continue
+				}
+				if target.IsDir {
+					continue
+				}
+			}
+
+			if fi.IsDir {
+				walk(name)
+				continue
+			}
+
+			if err := checkReadable(files, name); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: unreadable file: %v", name, errors.Cause(err)))
+			}
+		}
+	}
+	walk("/")
+
+	return problems
+}
+
+func checkReadable(files local.Files, name string) error {
+	f, err := files.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Read(make([]byte, 1))
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	return nil
+}
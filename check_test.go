@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gildasch/upspin-localserver/local"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"upspin.io/config"
+	"upspin.io/factotum"
+	"upspin.io/key/keygen"
+	"upspin.io/upspin"
+)
+
+func TestCheckTree(t *testing.T) {
+	root, err := ioutil.TempDir("", "check")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "subdir"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "subdir", "ok.txt"), []byte("ok"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "empty.txt"), nil, 0644))
+	require.NoError(t, os.Symlink("ok.txt", filepath.Join(root, "subdir", "link")))
+	require.NoError(t, os.Symlink("subdir", filepath.Join(root, "dirlink")))
+	require.NoError(t, os.Symlink("missing.txt", filepath.Join(root, "broken")))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "bad\xff.txt"), nil, 0644))
+
+	problems := checkTree(&local.Storage{Root: root}, "user@example.com")
+
+	assert.Equal(t, []string{
+		`"/bad\xff.txt": name is not valid UTF-8`,
+		"/broken: broken symbolic link to missing.txt",
+	}, problems)
+}
+
+func TestCheckTreeUnreadable(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("permissions are not enforced for root")
+	}
+
+	root, err := ioutil.TempDir("", "check")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "secret.txt"), []byte("secret"), 0000))
+	require.NoError(t, os.Mkdir(filepath.Join(root, "closed"), 0000))
+	defer os.Chmod(filepath.Join(root, "closed"), 0755)
+
+	problems := checkTree(&local.Storage{Root: root}, "user@example.com")
+
+	require.Len(t, problems, 2)
+	assert.Contains(t, problems[0], "/closed: unreadable directory")
+	assert.Contains(t, problems[1], "/secret.txt: unreadable file")
+}
+
+func TestCheckConfigWithoutKeys(t *testing.T) {
+	cfg := config.SetUserName(config.New(), upspin.UserName("user@example.com"))
+
+	assert.Equal(t, []string{"config: no keys loaded"}, checkConfig(cfg))
+}
+
+// newCheckConfig returns the config of user, whose keys are looked up on
+// the in-process key server.
+func newCheckConfig(t *testing.T, user upspin.UserName, f upspin.Factotum) upspin.Config {
+	registerInProcessKeyServer(t)
+
+	cfg := config.SetUserName(config.New(), user)
+	cfg = config.SetKeyEndpoint(cfg, upspin.Endpoint{Transport: upspin.InProcess})
+	return config.SetFactotum(cfg, f)
+}
+
+func newTestFactotum(t *testing.T) upspin.Factotum {
+	public, private, _, err := keygen.Generate("p256")
+	require.NoError(t, err)
+	f, err := factotum.NewFromKeys([]byte(public), []byte(private), nil)
+	require.NoError(t, err)
+	return f
+}
+
+func TestCheckConfig(t *testing.T) {
+	cfg := newCheckConfig(t, "check@example.com", newTestFactotum(t))
+
+	assert.Empty(t, checkConfig(cfg))
+}
+
+// mismatchedFactotum signs with its keys but gives the public key of
+// another pair, as when the public key file doesn't match the secret one.
+type mismatchedFactotum struct {
+	upspin.Factotum
+	public upspin.PublicKey
+}
+
+func (f mismatchedFactotum) PublicKey() upspin.PublicKey {
+	return f.public
+}
+
+func TestCheckConfigWithMismatchedKeys(t *testing.T) {
+	f := mismatchedFactotum{
+		Factotum: newTestFactotum(t),
+		public:   newTestFactotum(t).PublicKey(),
+	}
+	cfg := newCheckConfig(t, "mismatched@example.com", f)
+
+	problems := checkConfig(cfg)
+	require.Len(t, problems, 1)
+	assert.Contains(t, problems[0], "keys: signed entries do not unpack")
+}
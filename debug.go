@@ -0,0 +1,223 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"upspin.io/config"
+	"upspin.io/upspin"
+)
+
+// The ls, cat and stat subcommands call the Dir and Store of the server
+// in-process, so that what a client sees can be reproduced locally.
+
+func ls(args []string) {
+	d, _, names := localServers("ls", args)
+	runDebug(names, func(name upspin.PathName) error {
+		return listDir(os.Stdout, d, name)
+	})
+}
+
+func cat(args []string) {
+	d, s, names := localServers("cat", args)
+	runDebug(names, func(name upspin.PathName) error {
+		return catFile(os.Stdout, d, s, name)
+	})
+}
+
+func stat(args []string) {
+	d, _, names := localServers("stat", args)
+	runDebug(names, func(name upspin.PathName) error {
+		return statEntry(os.Stdout, d, name)
+	})
+}
+
+// localServers parses the flags of the debugging subcommand command and
+// returns the Dir and Store the server would use, dialed on behalf of the
+// requester, along with the path names given as arguments.
+func localServers(command string, args []string) (upspin.DirServer, upspin.StoreServer, []upspin.PathName) {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	configPtr := fs.String("config", "",
+		"the upspin config file of the server user")
+	rootPtr := fs.String("root", ".",
+		"the root directory to serve")
+	upperPtr := fs.String("upper", "",
+		"if set, a writable directory overlaid on top of the read-only root")
+	ignorePtr := fs.String("ignore", "",
+		"a file of gitignore-style rules hiding files of the whole tree")
+	hideDotfilesPtr := fs.Bool("hide-dotfiles", false,
+		"hide the files and directories starting with a dot")
+	keyPtr := fs.String("encryption-key", "",
+		"if set, a file holding the hex-encoded AES-256 key the files of the upper directory are encrypted with, the server refusing to start if one of them is not; the root is served as it is")
+	unixPermPtr := fs.Bool("unix-permissions", false,
+		"without an Access file, only let the owner access files not readable by everyone on the host")
+	blockSizePtr, chunkSizePtr := packingFlags(fs)
+	asPtr := fs.String("as", "",
+		"the user on behalf of whom the files are accessed (default the server user)")
+	fs.Parse(args)
+
+	cfg, err := newConfig(*configPtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not load the config: %v\n", err)
+		os.Exit(1)
+	}
+
+	storage, err := newStorage(*rootPtr, *upperPtr, *keyPtr, *ignorePtr, *hideDotfilesPtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not open the root: %v\n", err)
+		os.Exit(1)
+	}
+
+	simulator, chunks, err := newPacking(cfg, storage, *blockSizePtr, *chunkSizePtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	d, s := newServers(cfg, storage, *rootPtr, simulator, *unixPermPtr)
+	s.Chunks = chunks
+
+	requester := cfg
+	if *asPtr != "" {
+		requester = config.SetUserName(cfg, upspin.UserName(*asPtr))
+	}
+
+	dirService, err := d.Dial(requester, cfg.DirEndpoint())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not dial the directory server: %v\n", err)
+		os.Exit(1)
+	}
+	storeService, err := s.Dial(requester, cfg.StoreEndpoint())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not dial the store server: %v\n", err)
+		os.Exit(1)
+	}
+
+	names := []upspin.PathName{}
+	for _, arg := range fs.Args() {
+		names = append(names, pathName(cfg.UserName(), arg))
+	}
+	if len(names) == 0 {
+		names = append(names, pathName(cfg.UserName(), "/"))
+	}
+
+	return dirService.(upspin.DirServer), storeService.(upspin.StoreServer), names
+}
+
+// pathName returns the upspin path name of arg, which may be given
+// relative to the root of the server user.
+func pathName(user upspin.UserName, arg string) upspin.PathName {
+	if strings.HasPrefix(arg, "/") {
+		return upspin.PathName(string(user) + arg)
+	}
+	return upspin.PathName(arg)
+}
+
+func runDebug(names []upspin.PathName, run func(name upspin.PathName) error) {
+	failed := false
+	for _, name := range names {
+		if err := run(name); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// statEntry writes the DirEntry returned by d.Lookup for name.
+func statEntry(w io.Writer, d upspin.DirServer, name upspin.PathName) error {
+	de, err := d.Lookup(name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Name:       %s\n", de.Name)
+	fmt.Fprintf(w, "SignedName: %s\n", de.SignedName)
+	fmt.Fprintf(w, "Attr:       %s\n", attrString(de.Attr))
+	fmt.Fprintf(w, "Packing:    %s\n", de.Packing)
+	fmt.Fprintf(w, "Time:       %s\n", de.Time.Go().UTC())
+	fmt.Fprintf(w, "Writer:     %s\n", de.Writer)
+	fmt.Fprintf(w, "Sequence:   %d\n", de.Sequence)
+	if de.Link != "" {
+		fmt.Fprintf(w, "Link:       %s\n", de.Link)
+	}
+	fmt.Fprintf(w, "Packdata:   %x\n", de.Packdata)
+	fmt.Fprintf(w, "Blocks:     %d\n", len(de.Blocks))
+	for _, b := range de.Blocks {
+		fmt.Fprintf(w, "  %d+%d %s %s\n", b.Offset, b.Size, b.Location.Endpoint, b.Location.Reference)
+	}
+
+	return nil
+}
+
+// listDir writes the entries returned by d.Glob for the content of the
+// directory name, or for name itself if it is a pattern.
+func listDir(w io.Writer, d upspin.DirServer, name upspin.PathName) error {
+	pattern := string(name)
+	if !strings.ContainsAny(pattern, "*?[") {
+		pattern = path.Join(pattern, "*")
+	}
+
+	entries, err := d.Glob(pattern)
+	if err != nil {
+		return err
+	}
+
+	for _, de := range entries {
+		size, err := de.Size()
+		if err != nil {
+			return errors.Wrapf(err, "invalid blocks for %s", de.Name)
+		}
+		fmt.Fprintf(w, "%-4s %10d %s %s\n",
+			attrString(de.Attr), size, de.Time.Go().UTC().Format("2006-01-02 15:04:05"), de.Name)
+	}
+
+	return nil
+}
+
+// catFile writes the content of the file name, reassembled from the
+// blocks returned by s.Get for its DirEntry.
+func catFile(w io.Writer, d upspin.DirServer, s upspin.StoreServer, name upspin.PathName) error {
+	de, err := d.Lookup(name)
+	if err != nil {
+		return err
+	}
+	if de.IsDir() {
+		return errors.New("is a directory")
+	}
+
+	for _, b := range de.Blocks {
+		data, _, _, err := s.Get(b.Location.Reference)
+		if err != nil {
+			return errors.Wrapf(err, "could not get block %s", b.Location.Reference)
+		}
+		if int64(len(data)) != b.Size {
+			return errors.Errorf("block %s holds %d bytes, the entry says %d",
+				b.Location.Reference, len(data), b.Size)
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func attrString(attr upspin.Attribute) string {
+	switch {
+	case attr&upspin.AttrDirectory != 0:
+		return "dir"
+	case attr&upspin.AttrLink != 0:
+		return "link"
+	case attr&upspin.AttrIncomplete != 0:
+		return "inc"
+	}
+	return "file"
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gildasch/upspin-localserver/local"
+	"github.com/gildasch/upspin-localserver/packing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"upspin.io/config"
+	"upspin.io/factotum"
+	"upspin.io/test/testutil"
+	"upspin.io/upspin"
+)
+
+func newDebugServers(t *testing.T, root string) (upspin.DirServer, upspin.StoreServer) {
+	f, err := factotum.NewFromDir(testutil.Repo("key", "testdata", "user1"))
+	require.NoError(t, err)
+
+	cfg := config.New()
+	cfg = config.SetUserName(cfg, upspin.UserName("user@example.com"))
+	cfg = config.SetFactotum(cfg, f)
+
+	d, s := newServers(cfg, &local.Storage{Root: root}, root, packing.Plain{}, false)
+
+	dirService, err := d.Dial(cfg, upspin.Endpoint{})
+	require.NoError(t, err)
+	storeService, err := s.Dial(cfg, upspin.Endpoint{})
+	require.NoError(t, err)
+
+	return dirService.(upspin.DirServer), storeService.(upspin.StoreServer)
+}
+
+func TestCatFile(t *testing.T) {
+	root, err := ioutil.TempDir("", "debug")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), upspin.BlockSize/16+100)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "big.bin"), content, 0644))
+
+	d, s := newDebugServers(t, root)
+
+	var buf bytes.Buffer
+	require.NoError(t, catFile(&buf, d, s, "user@example.com/big.bin"))
+	assert.Equal(t, content, buf.Bytes())
+
+	assert.Error(t, catFile(&buf, d, s, "user@example.com/"))
+	assert.Error(t, catFile(&buf, d, s, "user@example.com/missing"))
+}
+
+func TestListDirAndStatEntry(t *testing.T) {
+	root, err := ioutil.TempDir("", "debug")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	require.NoError(t, os.Mkdir(filepath.Join(root, "subdir"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "a.txt"), []byte("hello"), 0644))
+
+	d, _ := newDebugServers(t, root)
+
+	var buf bytes.Buffer
+	require.NoError(t, listDir(&buf, d, "user@example.com/"))
+	assert.Contains(t, buf.String(), "file          5 ")
+	assert.Contains(t, buf.String(), " user@example.com/a.txt\n")
+	assert.Contains(t, buf.String(), " user@example.com/subdir\n")
+
+	buf.Reset()
+	require.NoError(t, statEntry(&buf, d, "user@example.com/a.txt"))
+	assert.Contains(t, buf.String(), "Name:       user@example.com/a.txt\n")
+	assert.Contains(t, buf.String(), "Blocks:     1\n  0+5 ")
+}
+
+func TestPathName(t *testing.T) {
+	assert.Equal(t, upspin.PathName("user@example.com/a/b"), pathName("user@example.com", "/a/b"))
+	assert.Equal(t, upspin.PathName("other@example.com/a"), pathName("user@example.com", "other@example.com/a"))
+}
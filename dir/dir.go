@@ -1,13 +1,19 @@
 package dir
 
 import (
-	"fmt"
+	"log/slog"
+	"os"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/gildasch/upspin-localserver/audit"
 	"github.com/gildasch/upspin-localserver/local"
+	"github.com/gildasch/upspin-localserver/logging"
 	"github.com/gildasch/upspin-localserver/packing"
-	"github.com/pkg/errors"
+	pkgerrors "github.com/pkg/errors"
 	"upspin.io/access"
+	"upspin.io/errors"
 	"upspin.io/path"
 	"upspin.io/serverutil"
 	"upspin.io/upspin"
@@ -20,15 +26,33 @@ type Storage interface {
 	List(pattern string) ([]local.FileInfo, error)
 }
 
+// Policy decides who can access the files served. A nil Policy lets
+// everyone access everything.
+type Policy interface {
+	Can(requester upspin.UserName, right access.Right, name string) (bool, error)
+}
+
+// Auditor records the accesses to the files served.
+type Auditor interface {
+	Record(e audit.Entry) error
+}
+
 type Dir struct {
 	upspin.DirServer
 
 	Username string
 	Root     string
 	Storage  Storage
-	Debug    bool
 	Factotum packing.Factotum
 	Packing  packing.Simulator
+	Policy   Policy
+
+	// Logger receives a record of every call. If nil, nothing is
+	// logged.
+	Logger *slog.Logger
+
+	// Audit, if set, records every Lookup and Glob.
+	Audit Auditor
 
 	// userName is the name of the user on behalf of whom this
 	// server is serving.
@@ -47,12 +71,14 @@ type Dir struct {
 }
 
 func (d *Dir) Dial(ctx upspin.Config, endpoint upspin.Endpoint) (upspin.Service, error) {
-	if d.Debug {
-		fmt.Printf("dir.Dial called with ctx=%#v, endpoint=%#v, ctx.UserName()=%#v, ctx.Factotum()=%#v, ctx.Packing()=%#v, ctx.KeyEndpoint()=%#v, ctx.DirEndpoint()=%#v, ctx.StoreEndpoint()=%#v\n", ctx, endpoint, ctx.UserName(), ctx.Factotum(), ctx.Packing(), ctx.KeyEndpoint(), ctx.DirEndpoint(), ctx.StoreEndpoint())
-	}
+	const op errors.Op = "dir.Dial"
+
+	start := time.Now()
 
 	if err := valid.UserName(ctx.UserName()); err != nil {
-		return nil, errors.Wrapf(err, "invalid username")
+		err = errors.E(op, ctx.UserName(), errors.Invalid, err)
+		d.logCall(ctx.UserName(), op, "", start, err)
+		return nil, err
 	}
 
 	cp := *d // copy of the generator instance.
@@ -62,104 +88,239 @@ func (d *Dir) Dial(ctx upspin.Config, endpoint upspin.Endpoint) (upspin.Service,
 	var err error
 	cp.userBase, cp.userSuffix, cp.userDomain, err = user.Parse(cp.userName)
 	if err != nil {
+		err = errors.E(op, cp.userName, errors.Invalid, err)
+		d.logCall(cp.userName, op, "", start, err)
 		return nil, err
 	}
 
 	// create a default Access file for this user.
 	cp.defaultAccess, err = access.New(upspin.PathName(cp.userName + "/"))
 	if err != nil {
+		err = errors.E(op, cp.userName, err)
+		d.logCall(cp.userName, op, "", start, err)
 		return nil, err
 	}
+
+	d.logCall(cp.userName, op, "", start, nil)
 	return &cp, nil
 }
 
 func (d *Dir) Endpoint() upspin.Endpoint {
-	if d.Debug {
-		fmt.Printf("dir.Endpoint called\n")
-	}
-
 	return upspin.Endpoint{}
 }
 
 func (d *Dir) Close() {
-	if d.Debug {
-		fmt.Printf("dir.Close called\n")
-	}
 }
 
 func (d *Dir) Lookup(name upspin.PathName) (*upspin.DirEntry, error) {
-	if d.Debug {
-		fmt.Printf("dir.Lookup called with name=%#v\n", name)
-	}
+	const op errors.Op = "dir.Lookup"
+
+	start := time.Now()
+	de, err := d.lookup(op, name)
+	d.logCall(d.userName, op, name, start, err)
+	d.record(op, name, err)
+
+	return de, err
+}
 
+func (d *Dir) lookup(op errors.Op, name upspin.PathName) (*upspin.DirEntry, error) {
 	p, err := path.Parse(name)
 	if err != nil {
-		return nil, errors.Wrap(err, "error parsing path")
+		return nil, errors.E(op, name, errors.Invalid, err)
 	}
 	if string(p.User()) != d.Username {
-		return nil,
-			fmt.Errorf("user %q is not known on this server", p.User())
+		return nil, errors.E(op, name, errors.NotExist,
+			errors.Errorf("user %q is not known on this server", p.User()))
+	}
+
+	// The access is checked first so that the users who have no right
+	// on a path can't tell whether it exists.
+	if !d.can(access.AnyRight, p.FilePath()) {
+		return nil, errors.E(op, name, errors.Private)
 	}
 
 	fi, err := d.Storage.Stat(p.FilePath())
 	if err != nil {
-		return nil,
-			fmt.Errorf("could not stat file %q: %v", p.FilePath(), err)
+		return nil, storageError(op, name, err)
 	}
 
-	de := d.Packing.DirEntry(d.Username, fi, d.Factotum)
-
-	if d.Debug {
-		fmt.Printf("dir.Lookup returning %#v\n", de)
+	de, err := d.Packing.DirEntry(d.Username, fi, d.Factotum)
+	if err != nil {
+		return nil, errors.E(op, name, err)
 	}
 
 	return de, nil
 }
 
 func (d *Dir) Glob(pattern string) ([]*upspin.DirEntry, error) {
-	if d.Debug {
-		fmt.Printf("dir.Glob called with pattern=%#v, d=%#v\n", pattern, d)
-	}
+	const op errors.Op = "dir.Glob"
+
+	start := time.Now()
+	entries, err := d.glob(op, pattern)
+	d.logCall(d.userName, op, upspin.PathName(pattern), start, err)
+	d.record(op, upspin.PathName(pattern), err)
+
+	return entries, err
+}
 
+func (d *Dir) glob(op errors.Op, pattern string) ([]*upspin.DirEntry, error) {
 	if !strings.HasPrefix(pattern, d.Username) {
-		return nil, errors.New("path unknown")
+		return nil, errors.E(op, upspin.PathName(pattern), errors.NotExist,
+			errors.Str("path unknown"))
 	}
 
-	entries, err := serverutil.Glob(pattern, d.Lookup, d.listDir)
+	entries, err := serverutil.Glob(pattern, d.lookupEntry, d.listDir)
 	if err != nil && err != upspin.ErrFollowLink {
-		return nil, errors.Wrap(err, "error during glob")
+		return nil, errors.E(op, upspin.PathName(pattern), err)
 	}
 
-	if d.Debug {
-		fmt.Printf("dir.Glob returning %#v\n", entries)
+	return entries, err
+}
+
+// Put is refused: the files are served read-only.
+func (d *Dir) Put(entry *upspin.DirEntry) (*upspin.DirEntry, error) {
+	const op errors.Op = "dir.Put"
+
+	var name upspin.PathName
+	if entry != nil {
+		name = entry.Name
 	}
+	return nil, d.refuse(op, name, errors.Permission, errors.Str("read-only server"))
+}
 
-	return entries, err
+// Delete is refused: the files are served read-only.
+func (d *Dir) Delete(name upspin.PathName) (*upspin.DirEntry, error) {
+	const op errors.Op = "dir.Delete"
+
+	return nil, d.refuse(op, name, errors.Permission, errors.Str("read-only server"))
+}
+
+// WhichAccess is not supported: the Access files are not served.
+func (d *Dir) WhichAccess(name upspin.PathName) (*upspin.DirEntry, error) {
+	const op errors.Op = "dir.WhichAccess"
+
+	return nil, d.refuse(op, name, errors.Invalid, errors.Str("not supported"))
+}
+
+// Watch is not supported, so that the clients poll for the changes.
+func (d *Dir) Watch(name upspin.PathName, sequence int64, done <-chan struct{}) (<-chan upspin.Event, error) {
+	const op errors.Op = "dir.Watch"
+
+	return nil, d.refuse(op, name, errors.Invalid, errors.Str("not supported"))
+}
+
+// refuse logs and returns the error of the call to op on name the server
+// does not serve.
+func (d *Dir) refuse(op errors.Op, name upspin.PathName, kind errors.Kind, err error) error {
+	err = errors.E(op, name, kind, err)
+	d.logCall(d.userName, op, name, time.Now(), err)
+	return err
+}
+
+// lookupEntry is Lookup without logging, for Glob.
+func (d *Dir) lookupEntry(name upspin.PathName) (*upspin.DirEntry, error) {
+	return d.lookup("dir.Lookup", name)
 }
 
 func (d *Dir) listDir(name upspin.PathName) ([]*upspin.DirEntry, error) {
-	if d.Debug {
-		fmt.Printf("dir.listDir called with name=%#v, d=%#v\n", name, d)
-	}
+	const op errors.Op = "dir.listDir"
 
 	pattern := strings.TrimPrefix(string(name), d.Username)
 
 	fis, err := d.Storage.List(pattern)
 	if err != nil {
-		return nil, errors.Wrap(err, "error reading dir")
+		return nil, storageError(op, name, err)
 	}
 
 	ret := []*upspin.DirEntry{}
 
 	for _, fi := range fis {
-		de := d.Packing.DirEntry(d.Username, fi, d.Factotum)
+		if !d.can(access.AnyRight, fi.Filename) {
+			continue
+		}
+		de, err := d.Packing.DirEntry(d.Username, fi, d.Factotum)
+		if err != nil {
+			return nil, errors.E(op, name, err)
+		}
 		ret = append(ret, de)
 	}
 
-	if d.Debug {
-		fmt.Printf("dir.listDir returning %#v\n", ret)
+	return ret, nil
+}
+
+// logCall logs the call to op by user on name, started at start, that
+// returned err. Failures of the server are logged as errors, the other
+// failures at the info level and the successes at the debug level.
+func (d *Dir) logCall(user upspin.UserName, op errors.Op, name upspin.PathName, start time.Time, err error) {
+	logger := d.Logger
+	if logger == nil {
+		return
+	}
+
+	attrs := []any{
+		"user", user,
+		"method", op,
+		"path", name,
+		"duration", time.Since(start),
+	}
+	if err == nil || err == upspin.ErrFollowLink {
+		logger.Debug("call", attrs...)
+		return
 	}
 
-	return ret, nil
+	attrs = append(attrs, "kind", logging.ErrorKind(err), "error", err)
+	if errors.Is(errors.IO, err) || errors.Is(errors.Internal, err) {
+		logger.Error("call failed", attrs...)
+		return
+	}
+	logger.Info("call failed", attrs...)
+}
 
+// record adds the call to op on name that returned err to the audit log.
+func (d *Dir) record(op errors.Op, name upspin.PathName, err error) {
+	if d.Audit == nil {
+		return
+	}
+
+	e := audit.Entry{
+		User:     d.userName,
+		Op:       string(op),
+		Path:     name,
+		Decision: audit.Decision(err),
+	}
+	if err != nil && err != upspin.ErrFollowLink {
+		e.Error = err.Error()
+	}
+
+	if err := d.Audit.Record(e); err != nil && d.Logger != nil {
+		d.Logger.Error("could not record access", "error", err)
+	}
+}
+
+// can reports whether the user on behalf of whom the server is serving
+// has the right on the file name. Failures to evaluate the policy deny
+// the access.
+func (d *Dir) can(right access.Right, name string) bool {
+	if d.Policy == nil {
+		return true
+	}
+
+	ok, err := d.Policy.Can(d.userName, right, name)
+	return err == nil && ok
+}
+
+// storageError returns the upspin error matching the failure err of the
+// Storage to access name.
+func storageError(op errors.Op, name upspin.PathName, err error) error {
+	cause := pkgerrors.Cause(err)
+	switch {
+	case os.IsNotExist(cause):
+		return errors.E(op, name, errors.NotExist, err)
+	case os.IsPermission(cause):
+		return errors.E(op, name, errors.Permission, err)
+	}
+	if pe, ok := cause.(*os.PathError); ok && pe.Err == syscall.ENOTDIR {
+		return errors.E(op, name, errors.NotDir, err)
+	}
+	return errors.E(op, name, errors.IO, err)
 }
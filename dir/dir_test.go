@@ -1,8 +1,11 @@
 package dir
 
 import (
-	"errors"
+	"bytes"
+	"encoding/json"
+	"log/slog"
 	"math/big"
+	"os"
 	"testing"
 
 	"github.com/gildasch/upspin-localserver/local"
@@ -11,6 +14,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"upspin.io/access"
 	"upspin.io/config"
+	"upspin.io/errors"
 	_ "upspin.io/store/transports"
 	"upspin.io/upspin"
 )
@@ -85,17 +89,36 @@ func (mf *MockFactotum) DirEntryHash(
 
 type MockPacking struct{}
 
-func (mp *MockPacking) DirEntry(username string, fi local.FileInfo, factotum packing.Factotum) *upspin.DirEntry {
+func (mp *MockPacking) DirEntry(username string, fi local.FileInfo, factotum packing.Factotum) (*upspin.DirEntry, error) {
+	if _, err := factotum.FileSign(nil); err != nil {
+		return nil, errors.E(upspin.PathName(username+fi.Filename), errors.Internal, err)
+	}
 	if fi.Filename == "/test_data/cba" {
 		return &upspin.DirEntry{
 			Name:     upspin.PathName(username + fi.Filename),
 			Sequence: 4321,
-		}
+		}, nil
 	}
 	return &upspin.DirEntry{
 		Name:     upspin.PathName(username + fi.Filename),
 		Sequence: 1234,
-	}
+	}, nil
+}
+
+type FailingFactotum struct {
+	MockFactotum
+}
+
+func (ff *FailingFactotum) FileSign(hash upspin.DEHash) (upspin.Signature, error) {
+	return upspin.Signature{}, errors.Str("no key")
+}
+
+type MockPolicy struct {
+	denied string
+}
+
+func (mp *MockPolicy) Can(requester upspin.UserName, right access.Right, name string) (bool, error) {
+	return name != mp.denied, nil
 }
 
 func TestDial(t *testing.T) {
@@ -106,7 +129,6 @@ func TestDial(t *testing.T) {
 		Username:      userName,
 		Root:          ".",
 		Storage:       &MockStorage{},
-		Debug:         false,
 		Factotum:      &MockFactotum{},
 		Packing:       &MockPacking{},
 		defaultAccess: defaultAccess,
@@ -133,9 +155,7 @@ func TestDial(t *testing.T) {
 }
 
 func TestEndpoint(t *testing.T) {
-	dir := Dir{
-		Debug: false,
-	}
+	dir := Dir{}
 
 	actual := dir.Endpoint()
 
@@ -143,9 +163,7 @@ func TestEndpoint(t *testing.T) {
 }
 
 func TestClose(t *testing.T) {
-	dir := Dir{
-		Debug: false,
-	}
+	dir := Dir{}
 
 	dir.Close()
 }
@@ -155,7 +173,6 @@ func TestLookupOK(t *testing.T) {
 		Username: "test.user@some-mail.com",
 		Root:     ".",
 		Storage:  &MockStorage{},
-		Debug:    false,
 		Factotum: &MockFactotum{},
 		Packing:  &MockPacking{},
 	}
@@ -177,28 +194,71 @@ func TestLookupErrors(t *testing.T) {
 		Username: "test.user@some-mail.com",
 		Root:     ".",
 		Storage:  storage,
-		Debug:    false,
 		Factotum: &MockFactotum{},
 		Packing:  &MockPacking{},
 	}
 
 	_, err := dir.Lookup("test.usersome-mail.com/test_data/abc")
-	assert.EqualError(t, err, "error parsing path: user.Parse: user test.usersome-mail.com: invalid operation: user name must contain one @ symbol")
+	assert.True(t, errors.Is(errors.Invalid, err))
 	_, err = dir.Lookup("user.test@some-mail.com/test_data/abc")
-	assert.EqualError(t, err, "user \"user.test@some-mail.com\" is not known on this server")
+	assert.True(t, errors.Is(errors.NotExist, err))
+	assert.True(t, errors.Match(errors.E(upspin.PathName("user.test@some-mail.com/test_data/abc")), err))
+
+	storage.err = errors.Str("dummy error")
+	_, err = dir.Lookup("test.user@some-mail.com/test_data/abc")
+	assert.True(t, errors.Is(errors.IO, err))
+	assert.True(t, errors.Match(errors.E(errors.Op("dir.Lookup"), upspin.PathName("test.user@some-mail.com/test_data/abc")), err))
 
-	storage.err = errors.New("dummy error")
+	storage.err = &os.PathError{Op: "open", Path: "test_data/abc", Err: os.ErrNotExist}
 	_, err = dir.Lookup("test.user@some-mail.com/test_data/abc")
-	assert.EqualError(t, err, "could not stat file \"test_data/abc\": dummy error")
+	assert.True(t, errors.Is(errors.NotExist, err))
+
+	storage.err = &os.PathError{Op: "open", Path: "test_data/abc", Err: os.ErrPermission}
+	_, err = dir.Lookup("test.user@some-mail.com/test_data/abc")
+	assert.True(t, errors.Is(errors.Permission, err))
 	storage.err = nil
 }
 
+func TestLookupLogsCalls(t *testing.T) {
+	var buf bytes.Buffer
+	storage := &MockStorage{}
+	dir := Dir{
+		Username: "test.user@some-mail.com",
+		Root:     ".",
+		Storage:  storage,
+		Factotum: &MockFactotum{},
+		Packing:  &MockPacking{},
+		Logger:   slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	}
+
+	_, err := dir.Lookup("test.user@some-mail.com/test_data/abc")
+	require.NoError(t, err)
+
+	storage.err = errors.Str("dummy error")
+	_, err = dir.Lookup("test.user@some-mail.com/test_data/abc")
+	require.Error(t, err)
+
+	dec := json.NewDecoder(&buf)
+	var ok, failed map[string]interface{}
+	require.NoError(t, dec.Decode(&ok))
+	require.NoError(t, dec.Decode(&failed))
+
+	assert.Equal(t, "DEBUG", ok["level"])
+	assert.Equal(t, "dir.Lookup", ok["method"])
+	assert.Equal(t, "test.user@some-mail.com/test_data/abc", ok["path"])
+	assert.Contains(t, ok, "duration")
+	assert.NotContains(t, ok, "kind")
+
+	assert.Equal(t, "ERROR", failed["level"])
+	assert.Equal(t, errors.IO.String(), failed["kind"])
+	assert.Contains(t, failed["error"], "dummy error")
+}
+
 func TestGlobOK(t *testing.T) {
 	dir := Dir{
 		Username: "test.user@some-mail.com",
 		Root:     ".",
 		Storage:  &MockStorage{},
-		Debug:    false,
 		Factotum: &MockFactotum{},
 		Packing:  &MockPacking{},
 	}
@@ -223,15 +283,111 @@ func TestGlobErrors(t *testing.T) {
 		Username: "test.user@some-mail.com",
 		Root:     ".",
 		Storage:  storage,
-		Debug:    false,
 		Factotum: &MockFactotum{},
 		Packing:  &MockPacking{},
 	}
 
 	_, err := dir.Glob("user.test@some-mail.com/test_data/*")
-	assert.EqualError(t, err, "path unknown")
+	assert.True(t, errors.Is(errors.NotExist, err))
+
+	storage.listError = errors.Str("dummy error")
+	_, err = dir.Glob("test.user@some-mail.com/test_data/*")
+	assert.True(t, errors.Is(errors.IO, err))
+	assert.True(t, errors.Match(errors.E(errors.Op("dir.Glob"), upspin.PathName("test.user@some-mail.com/test_data/*")), err))
 
-	storage.listError = errors.New("dummy error")
+	storage.listError = &os.PathError{Op: "readdirent", Path: "test_data", Err: os.ErrNotExist}
 	_, err = dir.Glob("test.user@some-mail.com/test_data/*")
-	assert.EqualError(t, err, "error during glob: test.user@some-mail.com/test_data: error reading dir: dummy error")
+	assert.True(t, errors.Is(errors.NotExist, err))
+}
+
+func TestChangesAreRefused(t *testing.T) {
+	dir := Dir{
+		Username: "test.user@some-mail.com",
+		Root:     ".",
+		Storage:  &MockStorage{},
+		Factotum: &MockFactotum{},
+		Packing:  &MockPacking{},
+	}
+	name := upspin.PathName("test.user@some-mail.com/test_data/abc")
+
+	_, err := dir.Put(&upspin.DirEntry{Name: name})
+	assert.True(t, errors.Is(errors.Permission, err))
+	assert.True(t, errors.Match(errors.E(errors.Op("dir.Put"), name), err))
+
+	_, err = dir.Put(nil)
+	assert.True(t, errors.Is(errors.Permission, err))
+
+	_, err = dir.Delete(name)
+	assert.True(t, errors.Is(errors.Permission, err))
+	assert.True(t, errors.Match(errors.E(errors.Op("dir.Delete"), name), err))
+
+	_, err = dir.WhichAccess(name)
+	assert.True(t, errors.Is(errors.Invalid, err))
+	assert.True(t, errors.Match(errors.E(errors.Op("dir.WhichAccess"), name), err))
+
+	events, err := dir.Watch(name, 0, nil)
+	assert.Nil(t, events)
+	assert.True(t, errors.Is(errors.Invalid, err))
+	assert.True(t, errors.Match(errors.E(errors.Op("dir.Watch"), name), err))
+}
+
+func TestPolicyHidesEntries(t *testing.T) {
+	dir := Dir{
+		Username: "test.user@some-mail.com",
+		Root:     ".",
+		Storage:  &MockStorage{},
+		Factotum: &MockFactotum{},
+		Packing:  &MockPacking{},
+		Policy:   &MockPolicy{denied: "/test_data/abc"},
+	}
+
+	_, err := dir.Lookup("test.user@some-mail.com/test_data/abc")
+	assert.True(t, errors.Is(errors.Private, err))
+
+	entries, err := dir.Glob("test.user@some-mail.com/test_data/*")
+
+	expected := []*upspin.DirEntry{
+		&upspin.DirEntry{
+			Name:     "test.user@some-mail.com/test_data/cba",
+			Sequence: 4321}}
+
+	assert.NoError(t, err)
+	assert.Equal(t, expected, entries)
+}
+
+func TestPolicyHidesExistence(t *testing.T) {
+	storage := &MockStorage{}
+	dir := Dir{
+		Username: "test.user@some-mail.com",
+		Root:     ".",
+		Storage:  storage,
+		Factotum: &MockFactotum{},
+		Packing:  &MockPacking{},
+		Policy:   &MockPolicy{denied: "/test_data/abc"},
+	}
+
+	_, existing := dir.Lookup("test.user@some-mail.com/test_data/abc")
+
+	storage.statError = &os.PathError{Op: "open", Path: "test_data/abc", Err: os.ErrNotExist}
+	_, missing := dir.Lookup("test.user@some-mail.com/test_data/abc")
+
+	assert.True(t, errors.Is(errors.Private, existing))
+	assert.True(t, errors.Is(errors.Private, missing))
+	assert.Equal(t, existing.Error(), missing.Error())
+}
+
+func TestSigningFailureReturnsError(t *testing.T) {
+	dir := Dir{
+		Username: "test.user@some-mail.com",
+		Root:     ".",
+		Storage:  &MockStorage{},
+		Factotum: &FailingFactotum{},
+		Packing:  &MockPacking{},
+	}
+
+	_, err := dir.Lookup("test.user@some-mail.com/test_data/abc")
+	assert.True(t, errors.Is(errors.Internal, err))
+
+	_, err = dir.listDir("test.user@some-mail.com/test_data")
+	assert.True(t, errors.Is(errors.Internal, err))
 }
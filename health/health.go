@@ -0,0 +1,95 @@
+// Package health serves the liveness and readiness of the server.
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Check is a condition the server must meet to serve correctly.
+type Check struct {
+	Name string
+	Func func() error
+}
+
+// Checks runs the readiness checks, each with Timeout.
+type Checks struct {
+	Checks  []Check
+	Timeout time.Duration
+}
+
+// Status is the JSON body of the responses.
+type Status struct {
+	Status string `json:"status"`
+	// Failed maps the names of the failed checks to their error.
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// Live serves the liveness of the process: it always succeeds.
+func Live(w http.ResponseWriter, r *http.Request) {
+	write(w, http.StatusOK, Status{Status: "ok"})
+}
+
+// Run runs the checks concurrently and returns the errors of the failed
+// ones by name.
+func (c *Checks) Run() map[string]string {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	var mu sync.Mutex
+	failed := map[string]string{}
+	var wg sync.WaitGroup
+
+	for _, check := range c.Checks {
+		wg.Add(1)
+		go func(check Check) {
+			defer wg.Done()
+
+			errc := make(chan error, 1)
+			go func() { errc <- check.Func() }()
+
+			var err error
+			select {
+			case err = <-errc:
+			case <-time.After(timeout):
+				err = errTimeout(timeout)
+			}
+			if err != nil {
+				mu.Lock()
+				failed[check.Name] = err.Error()
+				mu.Unlock()
+			}
+		}(check)
+	}
+	wg.Wait()
+
+	return failed
+}
+
+// ServeHTTP serves the readiness of the server: 200 if all the checks
+// pass, 503 with the failed ones otherwise.
+func (c *Checks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	failed := c.Run()
+	if len(failed) > 0 {
+		write(w, http.StatusServiceUnavailable, Status{Status: "unavailable", Failed: failed})
+		return
+	}
+	write(w, http.StatusOK, Status{Status: "ok"})
+}
+
+func write(w http.ResponseWriter, code int, s Status) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(s)
+}
+
+type errTimeout time.Duration
+
+func (e errTimeout) Error() string {
+	return "timed out after " + time.Duration(e).String()
+}
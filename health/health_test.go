@@ -0,0 +1,64 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serve(t *testing.T, h func(w *httptest.ResponseRecorder)) (int, Status) {
+	w := httptest.NewRecorder()
+	h(w)
+
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var s Status
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &s))
+	return w.Code, s
+}
+
+func TestLive(t *testing.T) {
+	code, s := serve(t, func(w *httptest.ResponseRecorder) {
+		Live(w, httptest.NewRequest("GET", "/healthz", nil))
+	})
+
+	assert.Equal(t, 200, code)
+	assert.Equal(t, Status{Status: "ok"}, s)
+}
+
+func TestChecks(t *testing.T) {
+	failing := errors.New("root is not readable")
+	checks := &Checks{
+		Checks: []Check{
+			{Name: "ok", Func: func() error { return nil }},
+			{Name: "root", Func: func() error { return failing }},
+			{Name: "slow", Func: func() error { time.Sleep(time.Second); return nil }},
+		},
+		Timeout: 10 * time.Millisecond,
+	}
+
+	code, s := serve(t, func(w *httptest.ResponseRecorder) {
+		checks.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	})
+
+	assert.Equal(t, 503, code)
+	assert.Equal(t, Status{
+		Status: "unavailable",
+		Failed: map[string]string{
+			"root": "root is not readable",
+			"slow": "timed out after 10ms",
+		},
+	}, s)
+
+	checks.Checks = checks.Checks[:1]
+	code, s = serve(t, func(w *httptest.ResponseRecorder) {
+		checks.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	})
+
+	assert.Equal(t, 200, code)
+	assert.Equal(t, Status{Status: "ok"}, s)
+}
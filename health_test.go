@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/gildasch/upspin-localserver/local"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"upspin.io/config"
+	"upspin.io/upspin"
+)
+
+func TestReadiness(t *testing.T) {
+	cfg := config.SetUserName(config.New(), upspin.UserName("user@example.com"))
+	index := &local.Index{Files: &local.Storage{Root: "/nonexistent"}}
+
+	failed := readiness(cfg, "/nonexistent", index).Run()
+
+	assert.Contains(t, failed["root"], "error reading dir")
+	assert.Equal(t, "no keys loaded", failed["factotum"])
+	assert.Equal(t, "not built yet", failed["index"])
+
+	failed = readiness(cfg, "local/test_data", nil).Run()
+
+	assert.NotContains(t, failed, "root")
+	assert.NotContains(t, failed, "index")
+}
+
+func TestReadinessChecksTheRootOnDisk(t *testing.T) {
+	cfg := config.SetUserName(config.New(), upspin.UserName("user@example.com"))
+	root, err := ioutil.TempDir("", "readiness")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	index := &local.Index{Files: &local.Storage{Root: root}}
+	require.NoError(t, index.Build())
+	require.NoError(t, os.RemoveAll(root))
+
+	// The index still lists the root from memory.
+	_, err = index.List("/")
+	require.NoError(t, err)
+
+	failed := readiness(cfg, root, index).Run()
+	assert.Contains(t, failed["root"], "error reading dir")
+	assert.NotContains(t, failed, "index")
+}
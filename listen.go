@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd.
+const listenFdsStart = 3
+
+// listen returns the listener described by spec:
+//   - "unix:<path>" for a Unix domain socket, created with mode and, if
+//     set, the "user:group" owner;
+//   - "systemd" for the socket passed by systemd socket activation;
+//   - "tcp:<addr>" or "<addr>" for a TCP address.
+//
+// An empty spec uses the socket passed by systemd if there is one, and
+// port otherwise.
+func listen(spec, port string, mode os.FileMode, owner string) (net.Listener, error) {
+	switch {
+	case spec == "" && os.Getenv("LISTEN_FDS") != "":
+		return systemdListener()
+	case spec == "":
+		return net.Listen("tcp", ":"+port)
+	case spec == "systemd":
+		return systemdListener()
+	case strings.HasPrefix(spec, "unix:"):
+		return unixListener(strings.TrimPrefix(spec, "unix:"), mode, owner)
+	}
+
+	return net.Listen("tcp", strings.TrimPrefix(spec, "tcp:"))
+}
+
+func unixListener(name string, mode os.FileMode, owner string) (net.Listener, error) {
+	// Remove the socket left by a previous run, but nothing else.
+	if fi, err := os.Lstat(name); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, errors.Errorf("%q exists and is not a socket", name)
+		}
+		if err := os.Remove(name); err != nil {
+			return nil, errors.Wrapf(err, "could not remove stale socket %q", name)
+		}
+	}
+
+	// The socket is created in a directory only the process can enter,
+	// so that nobody can connect before its owner and mode are set, and
+	// is then moved in place.
+	tmp, err := ioutil.TempDir(filepath.Dir(name), ".socket")
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not create the socket %q", name)
+	}
+	defer os.RemoveAll(tmp)
+
+	tmpName := filepath.Join(tmp, "socket")
+	ln, err := net.Listen("unix", tmpName)
+	if err != nil {
+		return nil, err
+	}
+	ul := ln.(*net.UnixListener)
+	ul.SetUnlinkOnClose(false)
+
+	if owner != "" {
+		uid, gid, err := lookupOwner(owner)
+		if err == nil {
+			err = os.Chown(tmpName, uid, gid)
+		}
+		if err != nil {
+			ln.Close()
+			return nil, errors.Wrapf(err, "could not set the owner of %q", name)
+		}
+	}
+
+	if err := os.Chmod(tmpName, mode); err != nil {
+		ln.Close()
+		return nil, errors.Wrapf(err, "could not set the mode of %q", name)
+	}
+
+	if err := os.Rename(tmpName, name); err != nil {
+		ln.Close()
+		return nil, errors.Wrapf(err, "could not create the socket %q", name)
+	}
+
+	return &unixSocket{UnixListener: ul, name: name}, nil
+}
+
+// unixSocket is a listener on the Unix domain socket name, removed when
+// it is closed.
+type unixSocket struct {
+	*net.UnixListener
+	name string
+}
+
+func (s *unixSocket) Close() error {
+	err := s.UnixListener.Close()
+	os.Remove(s.name)
+	return err
+}
+
+// lookupOwner returns the ids of owner, given as "user", "user:group" or
+// ":group" with names or numeric ids. Omitted parts are returned as -1.
+func lookupOwner(owner string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	parts := strings.SplitN(owner, ":", 2)
+
+	if parts[0] != "" {
+		uid, err = strconv.Atoi(parts[0])
+		if err != nil {
+			u, err := user.Lookup(parts[0])
+			if err != nil {
+				return 0, 0, err
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+
+	if len(parts) == 2 && parts[1] != "" {
+		gid, err = strconv.Atoi(parts[1])
+		if err != nil {
+			g, err := user.LookupGroup(parts[1])
+			if err != nil {
+				return 0, 0, err
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+
+	return uid, gid, nil
+}
+
+// systemdListener returns the socket passed by systemd, as described in
+// sd_listen_fds(3).
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("no socket passed by systemd to this process")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, errors.New("no socket passed by systemd to this process")
+	}
+	if n > 1 {
+		return nil, errors.Errorf("systemd passed %d sockets, expected one", n)
+	}
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(uintptr(listenFdsStart), "systemd")
+	defer f.Close()
+
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not use the socket passed by systemd")
+	}
+
+	return ln, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listen")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "usl.sock")
+
+	ln, err := listen("unix:"+name, "", 0600, "")
+	require.NoError(t, err)
+
+	fi, err := os.Stat(name)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	conn, err := net.Dial("unix", name)
+	require.NoError(t, err)
+	conn.Close()
+
+	// Only the socket is left in the directory, and it is removed once
+	// closed.
+	fis, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, fis, 1)
+	ln.Close()
+	_, err = os.Stat(name)
+	assert.True(t, os.IsNotExist(err))
+
+	// A socket left behind is replaced.
+	ln, err = net.Listen("unix", name)
+	require.NoError(t, err)
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	ln, err = listen("unix:"+name, "", 0660, "")
+	require.NoError(t, err)
+	ln.Close()
+}
+
+func TestListenUnixRefusesOtherFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listen")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(name, []byte("data"), 0644))
+
+	_, err = listen("unix:"+name, "", 0660, "")
+	assert.Error(t, err)
+
+	data, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+}
+
+func TestListenTCP(t *testing.T) {
+	ln, err := listen("tcp:127.0.0.1:0", "", 0, "")
+	require.NoError(t, err)
+	assert.Equal(t, "tcp", ln.Addr().Network())
+	ln.Close()
+}
+
+func TestListenSystemdForAnotherProcess(t *testing.T) {
+	os.Setenv("LISTEN_PID", "1")
+	os.Setenv("LISTEN_FDS", "1")
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+
+	_, err := listen("systemd", "", 0, "")
+	assert.Error(t, err)
+}
+
+func TestLookupOwner(t *testing.T) {
+	uid, gid, err := lookupOwner("1000:100")
+	require.NoError(t, err)
+	assert.Equal(t, 1000, uid)
+	assert.Equal(t, 100, gid)
+
+	uid, gid, err = lookupOwner(":100")
+	require.NoError(t, err)
+	assert.Equal(t, -1, uid)
+	assert.Equal(t, 100, gid)
+
+	uid, gid, err = lookupOwner("root")
+	require.NoError(t, err)
+	assert.Equal(t, 0, uid)
+	assert.Equal(t, -1, gid)
+
+	_, _, err = lookupOwner("no-such-user-here")
+	assert.Error(t, err)
+}
@@ -0,0 +1,311 @@
+package local
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// encryptedMagic starts every file written by Encrypted.
+	encryptedMagic = "USE1"
+
+	// noncePrefixLen is the length of the random part of the nonces of
+	// a file, the rest being the index of the segment.
+	noncePrefixLen = 8
+
+	encryptedHeaderLen = len(encryptedMagic) + noncePrefixLen
+
+	// segmentLen is the size of the cleartext segments each sealed
+	// separately, so that a block can be read without decrypting the
+	// whole file.
+	segmentLen = 64 * 1024
+	tagLen     = 16
+)
+
+// Encrypted stores the files of Files encrypted with AES-GCM under Key.
+// Each file has its own random nonce prefix and is split in segments
+// sealed separately, the last one being authenticated as such so that
+// truncations are detected.
+type Encrypted struct {
+	Files Files
+	Key   []byte
+}
+
+// ReadKeyFile reads a hex-encoded 32-byte key from the file name.
+func ReadKeyFile(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read key file %q", name)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not decode key file %q", name)
+	}
+	if len(key) != 32 {
+		return nil, errors.Errorf("key file %q must hold 32 bytes, got %d", name, len(key))
+	}
+
+	return key, nil
+}
+
+// isEncrypted reports whether the file name starts as the files written
+// by Encrypted do.
+func isEncrypted(name string) (bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(encryptedMagic))
+	if _, err := io.ReadFull(f, magic); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return string(magic) == encryptedMagic, nil
+}
+
+func (e *Encrypted) Open(name string) (File, error) {
+	f, err := e.Files.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "could not stat file %q", name)
+	}
+	if fi.IsDir() {
+		return f, nil
+	}
+
+	aead, err := e.aead()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	header := make([]byte, encryptedHeaderLen)
+	if _, err := f.ReadAt(header, 0); err != nil ||
+		string(header[:len(encryptedMagic)]) != encryptedMagic {
+		f.Close()
+		return nil, errors.Errorf("file %q is not encrypted", name)
+	}
+
+	return &encryptedFile{
+		file:   f,
+		aead:   aead,
+		prefix: header[len(encryptedMagic):],
+		size:   plainSize(fi.Size()),
+	}, nil
+}
+
+func (e *Encrypted) Stat(name string) (FileInfo, error) {
+	fi, err := e.Files.Stat(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	if !fi.IsDir {
+		fi.Size = plainSize(fi.Size)
+	}
+
+	return fi, nil
+}
+
+func (e *Encrypted) List(pattern string) ([]FileInfo, error) {
+	fis, err := e.Files.List(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range fis {
+		if !fis[i].IsDir {
+			fis[i].Size = plainSize(fis[i].Size)
+		}
+	}
+
+	return fis, nil
+}
+
+// WriteFile encrypts data and writes it to the file name, if Files
+// supports writing.
+func (e *Encrypted) WriteFile(name string, data []byte) error {
+	w, ok := e.Files.(interface {
+		WriteFile(name string, data []byte) error
+	})
+	if !ok {
+		return errors.Errorf("could not write file %q: storage is read-only", name)
+	}
+
+	sealed, err := e.seal(data)
+	if err != nil {
+		return errors.Wrapf(err, "could not encrypt file %q", name)
+	}
+
+	return w.WriteFile(name, sealed)
+}
+
+func (e *Encrypted) seal(data []byte) ([]byte, error) {
+	aead, err := e.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, noncePrefixLen)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(encryptedMagic)
+	buf.Write(prefix)
+
+	n := segments(int64(len(data)))
+	for i := int64(0); i < n; i++ {
+		end := (i + 1) * segmentLen
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		buf.Write(aead.Seal(nil,
+			nonce(prefix, i), data[i*segmentLen:end], segmentAD(i == n-1)))
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (e *Encrypted) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(e.Key)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid encryption key")
+	}
+
+	return cipher.NewGCM(block)
+}
+
+type encryptedFile struct {
+	file   File
+	aead   cipher.AEAD
+	prefix []byte
+	size   int64
+	offset int64
+}
+
+type encryptedFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi encryptedFileInfo) Size() int64 {
+	return fi.size
+}
+
+func (f *encryptedFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *encryptedFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.size {
+		return 0, io.EOF
+	}
+
+	n := 0
+	last := segments(f.size) - 1
+	for n < len(p) && off < f.size {
+		i := off / segmentLen
+		segment, err := f.segment(i, i == last)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p[n:], segment[off-i*segmentLen:])
+		n += c
+		off += int64(c)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *encryptedFile) segment(i int64, last bool) ([]byte, error) {
+	sealed := make([]byte, segmentLen+tagLen)
+	n, err := f.file.ReadAt(sealed, int64(encryptedHeaderLen)+i*(segmentLen+tagLen))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	segment, err := f.aead.Open(nil, nonce(f.prefix, i), sealed[:n], segmentAD(last))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not decrypt segment %d", i)
+	}
+
+	return segment, nil
+}
+
+func (f *encryptedFile) Close() error {
+	return f.file.Close()
+}
+
+func (f *encryptedFile) Stat() (os.FileInfo, error) {
+	fi, err := f.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return encryptedFileInfo{FileInfo: fi, size: f.size}, nil
+}
+
+// segments returns the number of segments of a file of size cleartext
+// bytes. Empty files still hold one empty, authenticated segment.
+func segments(size int64) int64 {
+	if size == 0 {
+		return 1
+	}
+	return (size + segmentLen - 1) / segmentLen
+}
+
+// plainSize returns the size of the cleartext of an encrypted file of
+// size bytes.
+func plainSize(size int64) int64 {
+	size -= int64(encryptedHeaderLen)
+	if size <= 0 {
+		return 0
+	}
+
+	n := (size + segmentLen + tagLen - 1) / (segmentLen + tagLen)
+	return size - n*tagLen
+}
+
+func nonce(prefix []byte, i int64) []byte {
+	n := make([]byte, noncePrefixLen+4)
+	copy(n, prefix)
+	binary.BigEndian.PutUint32(n[noncePrefixLen:], uint32(i))
+	return n
+}
+
+func segmentAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
@@ -0,0 +1,111 @@
+package local
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	e := &Encrypted{
+		Files: &Storage{Root: t.TempDir()},
+		Key:   bytes.Repeat([]byte{42}, 32),
+	}
+
+	cases := map[string][]byte{
+		"empty":         {},
+		"small.txt":     []byte("hello world!\n"),
+		"segment":       bytes.Repeat([]byte{1}, segmentLen),
+		"dir/large.bin": bytes.Repeat([]byte("0123456789"), 3*segmentLen/10+7),
+	}
+
+	for name, content := range cases {
+		require.NoError(t, e.WriteFile(name, content))
+
+		onDisk, err := ioutil.ReadFile(filepath.Join(e.Files.(*Storage).Root, name))
+		require.NoError(t, err)
+		if len(content) > 0 {
+			assert.False(t, bytes.Contains(onDisk, content[:len(content)/2+1]), name)
+		}
+
+		fi, err := e.Stat(name)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(content)), fi.Size, name)
+
+		f, err := e.Open(name)
+		require.NoError(t, err)
+		actual, err := ioutil.ReadAll(f)
+		assert.NoError(t, err)
+		assert.Equal(t, content, actual, name)
+		f.Close()
+	}
+}
+
+func TestEncryptedReadAt(t *testing.T) {
+	e := &Encrypted{
+		Files: &Storage{Root: t.TempDir()},
+		Key:   bytes.Repeat([]byte{42}, 32),
+	}
+
+	content := bytes.Repeat([]byte("abcdefghij"), segmentLen/5)
+	require.NoError(t, e.WriteFile("file", content))
+
+	f, err := e.Open("file")
+	require.NoError(t, err)
+	defer f.Close()
+
+	p := make([]byte, 100)
+	n, err := f.ReadAt(p, segmentLen-50)
+	assert.NoError(t, err)
+	assert.Equal(t, content[segmentLen-50:segmentLen+50], p[:n])
+
+	n, err = f.ReadAt(p, int64(len(content))-10)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, content[len(content)-10:], p[:n])
+}
+
+func TestEncryptedDetectsTampering(t *testing.T) {
+	e := &Encrypted{
+		Files: &Storage{Root: t.TempDir()},
+		Key:   bytes.Repeat([]byte{42}, 32),
+	}
+
+	content := bytes.Repeat([]byte{7}, 2*segmentLen)
+	require.NoError(t, e.WriteFile("file", content))
+	path := filepath.Join(e.Files.(*Storage).Root, "file")
+
+	onDisk, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	truncated := onDisk[:encryptedHeaderLen+segmentLen+tagLen]
+	require.NoError(t, ioutil.WriteFile(path, truncated, 0644))
+
+	f, err := e.Open("file")
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(f)
+	assert.Error(t, err)
+	f.Close()
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("plain text"), 0644))
+	_, err = e.Open("file")
+	assert.Error(t, err)
+}
+
+func TestPlainSize(t *testing.T) {
+	cases := map[int64]int64{
+		0:                    0,
+		1:                    1,
+		segmentLen:           segmentLen,
+		segmentLen + 1:       segmentLen + 1,
+		3*segmentLen + 12345: 3*segmentLen + 12345,
+	}
+
+	for plain := range cases {
+		sealed := int64(encryptedHeaderLen) + plain + segments(plain)*tagLen
+		assert.Equal(t, cases[plain], plainSize(sealed))
+	}
+}
@@ -0,0 +1,378 @@
+package local
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// IgnoreFile is the name of the files holding the gitignore-style rules
+// of the directory they are in and of its subdirectories.
+const IgnoreFile = ".upspinignore"
+
+const (
+	// ignoreRecheck is how long the rules of a directory are used before
+	// checking whether its IgnoreFile changed.
+	ignoreRecheck = time.Second
+
+	// maxIgnoreDirs is the number of directories whose rules are kept.
+	maxIgnoreDirs = 10000
+)
+
+// Files is implemented by Storage and by the types wrapping it.
+type Files interface {
+	Open(name string) (File, error)
+	Stat(name string) (FileInfo, error)
+	List(pattern string) ([]FileInfo, error)
+}
+
+// Filter hides the files of Files matched by the rules of the
+// IgnoreFile of their directory or of any of its parents, by the Global
+// rules and, if HideDotfiles is set, the files starting with a dot.
+//
+// The rules are parsed once and kept: Global must not change once the
+// Filter is used, and the changes to the IgnoreFiles are seen within
+// ignoreRecheck.
+type Filter struct {
+	Files        Files
+	Global       []string
+	HideDotfiles bool
+
+	mu     sync.Mutex
+	global *ignoreRules
+	dirs   map[string]*dirRules
+
+	// now is time.Now, replaced in tests.
+	now func() time.Time
+}
+
+// dirRules are the rules of the IgnoreFile of a directory, if any, along
+// with the version of the file they were read from.
+type dirRules struct {
+	rules   *ignoreRules
+	size    int64
+	time    time.Time
+	checked time.Time
+}
+
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreRules is the list of rules of an IgnoreFile, along with the
+// directory they are relative to.
+type ignoreRules struct {
+	base  string
+	rules []ignoreRule
+}
+
+// ReadIgnoreFile returns the rules of the gitignore-style file name,
+// one per line.
+func ReadIgnoreFile(name string) ([]string, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read ignore file %q", name)
+	}
+
+	return strings.Split(string(data), "\n"), nil
+}
+
+func (f *Filter) Open(name string) (File, error) {
+	file, err := f.Files.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "could not stat file %q", name)
+	}
+
+	if f.Ignored(name, fi.IsDir()) {
+		file.Close()
+		return nil, errors.Wrapf(notExist("open", name), "could not open file %q", name)
+	}
+
+	return file, nil
+}
+
+func (f *Filter) Stat(name string) (FileInfo, error) {
+	fi, err := f.Files.Stat(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	if f.Ignored(name, fi.IsDir) {
+		return FileInfo{}, errors.Wrapf(notExist("stat", name), "could not stat file %q", name)
+	}
+
+	return fi, nil
+}
+
+func (f *Filter) List(pattern string) ([]FileInfo, error) {
+	dir := filepath.Clean("/" + pattern)
+	if f.Ignored(dir, true) {
+		return nil, errors.Wrap(notExist("readdir", pattern), "error reading dir")
+	}
+
+	fis, err := f.Files.List(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	chain := f.chain(dir)
+	infos := []FileInfo{}
+
+	for _, fi := range fis {
+		if f.match(chain, filepath.Join(dir, filepath.Base(fi.Filename)), fi.IsDir) {
+			continue
+		}
+		infos = append(infos, fi)
+	}
+
+	return infos, nil
+}
+
+// Ignored reports whether the file name, or one of its parent
+// directories, is hidden by the rules.
+func (f *Filter) Ignored(name string, isDir bool) bool {
+	clean := filepath.Clean("/" + name)
+	if clean == "/" {
+		return false
+	}
+
+	chain := []ignoreRules{*f.globalRules()}
+	dir := "/"
+	parts := strings.Split(clean[1:], "/")
+	for i, part := range parts {
+		if rs := f.rules(dir); rs != nil {
+			chain = append(chain, *rs)
+		}
+		p := filepath.Join(dir, part)
+		if f.match(chain, p, i < len(parts)-1 || isDir) {
+			return true
+		}
+		dir = p
+	}
+
+	return false
+}
+
+// match reports whether the last rule of the chain matching name
+// excludes it.
+func (f *Filter) match(chain []ignoreRules, name string, isDir bool) bool {
+	base := filepath.Base(name)
+	if base == IgnoreFile {
+		return true
+	}
+	if f.HideDotfiles && strings.HasPrefix(base, ".") {
+		return true
+	}
+
+	ignored := false
+	for _, rs := range chain {
+		rel := strings.TrimPrefix(strings.TrimPrefix(name, rs.base), "/")
+		for _, r := range rs.rules {
+			if r.dirOnly && !isDir {
+				continue
+			}
+			if r.re.MatchString(rel) {
+				ignored = !r.negate
+			}
+		}
+	}
+
+	return ignored
+}
+
+// chain returns the rules applying to the entries of the directory dir,
+// from the least to the most specific.
+func (f *Filter) chain(dir string) []ignoreRules {
+	dirs := []string{}
+	for d := dir; ; d = filepath.Dir(d) {
+		dirs = append([]string{d}, dirs...)
+		if d == "/" {
+			break
+		}
+	}
+
+	chain := []ignoreRules{*f.globalRules()}
+	for _, d := range dirs {
+		if rs := f.rules(d); rs != nil {
+			chain = append(chain, *rs)
+		}
+	}
+
+	return chain
+}
+
+func (f *Filter) globalRules() *ignoreRules {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.global == nil {
+		f.global = &ignoreRules{base: "/", rules: parseIgnoreRules(f.Global)}
+	}
+	return f.global
+}
+
+// rules returns the rules of the IgnoreFile of the directory dir, or nil
+// if it has none. They are read again when the file changes.
+func (f *Filter) rules(dir string) *ignoreRules {
+	now := f.clock()
+
+	f.mu.Lock()
+	cached, ok := f.dirs[dir]
+	f.mu.Unlock()
+	if ok && now.Sub(cached.checked) < ignoreRecheck {
+		return cached.rules
+	}
+
+	name := filepath.Join(dir, IgnoreFile)
+	d := &dirRules{checked: now}
+	if fi, err := f.Files.Stat(name); err == nil && !fi.IsDir {
+		d.size, d.time = fi.Size, fi.Time
+		if ok && cached.rules != nil && cached.size == d.size && cached.time.Equal(d.time) {
+			d.rules = cached.rules
+		} else {
+			d.rules = f.readRules(dir, name)
+		}
+	}
+
+	f.mu.Lock()
+	if f.dirs == nil || len(f.dirs) >= maxIgnoreDirs {
+		f.dirs = map[string]*dirRules{}
+	}
+	f.dirs[dir] = d
+	f.mu.Unlock()
+
+	return d.rules
+}
+
+// Forget drops the rules kept for the directory dir, for its IgnoreFile
+// to be read again on the next use.
+func (f *Filter) Forget(dir string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.dirs, filepath.Clean("/"+dir))
+}
+
+// readRules parses the IgnoreFile name of the directory dir.
+func (f *Filter) readRules(dir, name string) *ignoreRules {
+	file, err := f.Files.Open(name)
+	if err != nil {
+		return nil
+	}
+	data, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return nil
+	}
+
+	lines := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	return &ignoreRules{base: dir, rules: parseIgnoreRules(lines)}
+}
+
+func (f *Filter) clock() time.Time {
+	if f.now != nil {
+		return f.now()
+	}
+	return time.Now()
+}
+
+func parseIgnoreRules(lines []string) []ignoreRule {
+	rules := []ignoreRule{}
+
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		r := ignoreRule{}
+		if strings.HasPrefix(line, "!") {
+			r.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+
+		expr := "^" + globToRegexp(strings.TrimPrefix(line, "/")) + "$"
+		if !strings.Contains(line, "/") {
+			// Patterns without a slash match at any depth.
+			expr = "^(.*/)?" + globToRegexp(line) + "$"
+		}
+
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			continue
+		}
+		r.re = re
+		rules = append(rules, r)
+	}
+
+	return rules
+}
+
+func globToRegexp(glob string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			b.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return b.String()
+}
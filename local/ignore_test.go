@@ -0,0 +1,188 @@
+package local
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ignoreFiles are the files of the trees filtered in the tests.
+var ignoreFiles = map[string]string{
+	".upspinignore":         "*.swp\n/build/\nsecret*\n!secret.pub\n# comment\n",
+	".env":                  "TOKEN=xyz",
+	"main.go":               "package main",
+	"main.go.swp":           "",
+	"secret.key":            "",
+	"secret.pub":            "",
+	"build/out":             "",
+	"src/build/keep":        "",
+	"src/.upspinignore":     "*.log\n",
+	"src/app.log":           "",
+	"src/app.go":            "",
+	"src/vendor/lib/lib.go": "",
+	".git/config":           "",
+}
+
+func TestFilterIgnored(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, ignoreFiles)
+	f := &Filter{
+		Files:  &Storage{Root: root},
+		Global: []string{"vendor/"},
+	}
+
+	cases := map[string]bool{
+		"main.go":               false,
+		"main.go.swp":           true,
+		"secret.key":            true,
+		"secret.pub":            false,
+		"build/out":             true,
+		"src/build/keep":        false,
+		"src/app.log":           true,
+		"src/app.go":            false,
+		"src/vendor/lib/lib.go": true,
+		".upspinignore":         true,
+		"src/.upspinignore":     true,
+		".env":                  false,
+	}
+
+	for in, expected := range cases {
+		assert.Equal(t, expected, f.Ignored(in, false), in)
+	}
+}
+
+func TestFilterHideDotfiles(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, ignoreFiles)
+	f := &Filter{
+		Files:  &Storage{Root: root},
+		Global: []string{"vendor/"},
+	}
+
+	f.HideDotfiles = true
+
+	assert.True(t, f.Ignored(".env", false))
+	assert.True(t, f.Ignored(".git/config", false))
+	assert.False(t, f.Ignored("main.go", false))
+}
+
+func TestFilterStatAndOpen(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, ignoreFiles)
+	f := &Filter{
+		Files:  &Storage{Root: root},
+		Global: []string{"vendor/"},
+	}
+
+	_, err := f.Stat("main.go")
+	assert.NoError(t, err)
+	_, err = f.Stat("secret.key")
+	assert.Error(t, err)
+	_, err = f.Stat("build")
+	assert.Error(t, err)
+
+	file, err := f.Open("main.go")
+	assert.NoError(t, err)
+	file.Close()
+	file, err = f.Open("src/app.log")
+	assert.Error(t, err)
+	assert.Nil(t, file)
+}
+
+func TestFilterList(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, ignoreFiles)
+	f := &Filter{
+		Files:  &Storage{Root: root},
+		Global: []string{"vendor/"},
+	}
+
+	fis, err := f.List("/")
+	assert.NoError(t, err)
+	assert.Equal(t,
+		[]string{"/.env", "/.git", "/main.go", "/secret.pub", "/src"},
+		filenames(fis))
+
+	fis, err = f.List("src")
+	assert.NoError(t, err)
+	assert.Equal(t,
+		[]string{"src/app.go", "src/build"},
+		filenames(fis))
+
+	_, err = f.List("build")
+	assert.Error(t, err)
+}
+
+func TestGlobToRegexp(t *testing.T) {
+	cases := map[string]string{
+		"*.go":    `[^/]*\.go`,
+		"a?c":     `a[^/]c`,
+		"**/x":    `(.*/)?x`,
+		"a/**":    `a/.*`,
+		"a/**/b":  `a/(.*/)?b`,
+		"[!ab]c":  `[^ab]c`,
+		`\*`:      `\*`,
+		"[abc":    `\[abc`,
+		"dir.txt": `dir\.txt`,
+	}
+
+	for in, expected := range cases {
+		assert.Equal(t, expected, globToRegexp(in), in)
+	}
+}
+
+// countingFiles counts the IgnoreFiles opened.
+type countingFiles struct {
+	Files
+	opened int
+}
+
+func (c *countingFiles) Open(name string) (File, error) {
+	if filepath.Base(name) == IgnoreFile {
+		c.opened++
+	}
+	return c.Files.Open(name)
+}
+
+func TestFilterKeepsRules(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, ignoreFiles)
+	files := &countingFiles{Files: &Storage{Root: root}}
+	f := &Filter{
+		Files:  files,
+		Global: []string{"vendor/"},
+	}
+
+	now := time.Unix(1000, 0)
+	f.now = func() time.Time { return now }
+
+	for i := 0; i < 10; i++ {
+		assert.True(t, f.Ignored("src/app.log", false))
+		assert.False(t, f.Ignored("src/vendor2/lib.go", false))
+		_, err := f.List("src")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 2, files.opened, "each IgnoreFile is read once")
+
+	// A modified IgnoreFile is read again once the rules are checked.
+	p := filepath.Join(root, "src", IgnoreFile)
+	require.NoError(t, ioutil.WriteFile(p, []byte("*.go\n"), 0644))
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(p, later, later))
+
+	assert.True(t, f.Ignored("src/app.log", false), "the old rules are kept until checked")
+	now = now.Add(2 * ignoreRecheck)
+	assert.False(t, f.Ignored("src/app.log", false))
+	assert.True(t, f.Ignored("src/app.go", false))
+	assert.Equal(t, 3, files.opened)
+
+	// So is a removed one.
+	require.NoError(t, os.Remove(p))
+	now = now.Add(2 * ignoreRecheck)
+	assert.False(t, f.Ignored("src/app.go", false))
+}
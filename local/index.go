@@ -0,0 +1,586 @@
+package local
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// Index serves the metadata of Files from memory. It is filled by a
+// walk of the whole tree and, once Watch is called, kept current by
+// watching the host directories Roots backing Files. Until the first
+// walk is over, the calls are passed through to Files.
+type Index struct {
+	Files Files
+	Roots []string
+
+	// OnChange, if set, is called with the name of every file found
+	// modified, created or deleted after the first walk.
+	OnChange func(name string)
+
+	mu       sync.RWMutex
+	ready    bool
+	entries  map[string]FileInfo
+	children map[string][]string
+	watcher  *fsnotify.Watcher
+
+	// failed holds the errors of the directories that could not be
+	// listed, whose content is missing from the index.
+	failed map[string]error
+
+	// pending holds the names of the files changed while Build walks
+	// the tree. It is nil outside of Build.
+	pending map[string]bool
+}
+
+// ruleCache is implemented by the Files keeping the rules of the
+// IgnoreFiles, such as Filter.
+type ruleCache interface {
+	Forget(dir string)
+}
+
+// fileID identifies a directory on the host, to detect the symbolic
+// links looping back to one of its parents.
+type fileID struct {
+	dev, ino uint64
+}
+
+// indexSnapshot is the on-disk representation of an Index.
+type indexSnapshot struct {
+	Entries  map[string]FileInfo
+	Children map[string][]string
+}
+
+func (i *Index) Open(name string) (File, error) {
+	return i.Files.Open(name)
+}
+
+func (i *Index) Stat(name string) (FileInfo, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if !i.ready {
+		return i.Files.Stat(name)
+	}
+
+	fi, ok := i.entries[path.Clean("/"+name)]
+	if !ok {
+		return FileInfo{}, errors.Wrapf(notExist("stat", name), "could not stat file %q", name)
+	}
+
+	return fi, nil
+}
+
+func (i *Index) List(pattern string) ([]FileInfo, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if !i.ready {
+		return i.Files.List(pattern)
+	}
+
+	dir := path.Clean("/" + pattern)
+	if fi, ok := i.entries[dir]; !ok || !fi.IsDir {
+		return nil, errors.Wrap(notExist("readdir", pattern), "error reading dir")
+	}
+	if err, ok := i.failed[dir]; ok {
+		return nil, err
+	}
+
+	infos := []FileInfo{}
+	for _, child := range i.children[dir] {
+		infos = append(infos, i.entries[path.Join(dir, child)])
+	}
+
+	return infos, nil
+}
+
+// Ready reports whether the index is serving from memory.
+func (i *Index) Ready() bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.ready
+}
+
+// Build walks the whole tree and replaces the content of the index.
+// The directories are watched before being listed, and the changes seen
+// during the walk are applied once it is over. The directories that
+// can't be listed are left out, as told by Unreadable, but only a root
+// that can't be listed fails the walk.
+func (i *Index) Build() error {
+	i.mu.Lock()
+	i.pending = map[string]bool{}
+	i.mu.Unlock()
+
+	entries, children, failed, err := i.walkAll(i.watch)
+
+	i.mu.Lock()
+	pending := i.pending
+	i.pending = nil
+	if err == nil {
+		i.entries, i.children, i.failed = entries, children, failed
+		i.ready = true
+	}
+	i.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	for name := range pending {
+		i.notify([]string{name})
+		i.apply(name)
+	}
+
+	return nil
+}
+
+// Unreadable returns the errors of the directories whose content is
+// missing from the index, by name.
+func (i *Index) Unreadable() map[string]error {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	failed := map[string]error{}
+	for dir, err := range i.failed {
+		failed[dir] = err
+	}
+	return failed
+}
+
+// Check walks the tree and returns the differences found with the
+// content of the index.
+func (i *Index) Check() ([]string, error) {
+	entries, _, _, err := i.walkAll(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	diffs := []string{}
+	for name, fi := range entries {
+		indexed, ok := i.entries[name]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("%s: missing from the index", name))
+		case indexed.IsDir != fi.IsDir || indexed.Size != fi.Size ||
+			!indexed.Time.Equal(fi.Time):
+			diffs = append(diffs, fmt.Sprintf("%s: stale in the index", name))
+		}
+	}
+	for name := range i.entries {
+		if _, ok := entries[name]; !ok {
+			diffs = append(diffs, fmt.Sprintf("%s: deleted but still in the index", name))
+		}
+	}
+	sort.Strings(diffs)
+
+	return diffs, nil
+}
+
+// Save writes a snapshot of the index to the file name.
+func (i *Index) Save(name string) error {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	snapshot := indexSnapshot{Entries: i.entries, Children: i.children}
+
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrapf(err, "could not create snapshot %q", name)
+	}
+
+	if err := gob.NewEncoder(f).Encode(snapshot); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errors.Wrapf(err, "could not write snapshot %q", name)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "could not write snapshot %q", name)
+	}
+
+	return os.Rename(tmp, name)
+}
+
+// Load fills the index from the snapshot file name, so that it can
+// serve before the first walk is over.
+func (i *Index) Load(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return errors.Wrapf(err, "could not open snapshot %q", name)
+	}
+	defer f.Close()
+
+	var snapshot indexSnapshot
+	if err := gob.NewDecoder(f).Decode(&snapshot); err != nil {
+		return errors.Wrapf(err, "could not read snapshot %q", name)
+	}
+	if _, ok := snapshot.Entries["/"]; !ok {
+		return errors.Errorf("snapshot %q has no root", name)
+	}
+
+	i.mu.Lock()
+	i.entries, i.children = snapshot.Entries, snapshot.Children
+	i.failed = map[string]error{}
+	i.ready = true
+	i.mu.Unlock()
+
+	return nil
+}
+
+// Watch starts updating the index on the changes of the files under
+// Roots. It must be called before Build for the changes made during the
+// walk to be seen.
+func (i *Index) Watch() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "could not watch files")
+	}
+
+	i.mu.Lock()
+	i.watcher = w
+	i.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				i.handle(event.Name)
+			case _, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Close stops watching the files.
+func (i *Index) Close() error {
+	i.mu.Lock()
+	w := i.watcher
+	i.watcher = nil
+	i.mu.Unlock()
+
+	if w == nil {
+		return nil
+	}
+	return w.Close()
+}
+
+func (i *Index) handle(hostname string) {
+	for _, root := range i.Roots {
+		rel, err := filepath.Rel(root, hostname)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		name := path.Clean("/" + filepath.ToSlash(rel))
+		if !i.queue(name) {
+			i.apply(name)
+		}
+		return
+	}
+}
+
+// apply updates the index for the change of the file name. A change of
+// an IgnoreFile may hide or show files anywhere under its directory,
+// which is walked again.
+func (i *Index) apply(name string) {
+	if path.Base(name) != IgnoreFile {
+		i.refresh(parent(name))
+		return
+	}
+
+	dir := parent(name)
+	if rc, ok := i.Files.(ruleCache); ok {
+		rc.Forget(dir)
+	}
+	i.reload(dir)
+}
+
+// queue keeps name to be refreshed at the end of the running Build, if
+// any, and reports whether it did.
+func (i *Index) queue(name string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.pending == nil {
+		return false
+	}
+	i.pending[name] = true
+	return true
+}
+
+// parent returns the directory listing name, the root being its own.
+func parent(name string) string {
+	if name == "/" {
+		return name
+	}
+	return path.Dir(name)
+}
+
+// refresh lists the directory dir again and updates the entries of its
+// children, walking the new subdirectories.
+func (i *Index) refresh(dir string) {
+	i.mu.RLock()
+	ready := i.ready
+	i.mu.RUnlock()
+	if !ready {
+		return
+	}
+
+	changed := []string{}
+
+	fis, err := i.Files.List(dir)
+	if err != nil {
+		i.mu.Lock()
+		if fi, serr := i.Files.Stat(dir); serr == nil && fi.IsDir {
+			// The directory is still there but can't be read.
+			for _, child := range i.children[dir] {
+				changed = append(changed, i.removeLocked(path.Join(dir, child))...)
+			}
+			i.entries[dir] = fi
+			i.failed[dir] = err
+		} else {
+			changed = i.removeLocked(dir)
+		}
+		i.mu.Unlock()
+		i.notify(changed)
+		return
+	}
+
+	if fi, err := i.Files.Stat(dir); err == nil {
+		i.mu.Lock()
+		i.entries[dir] = fi
+		delete(i.failed, dir)
+		i.mu.Unlock()
+	}
+
+	current := map[string]FileInfo{}
+	for _, fi := range fis {
+		current[path.Join(dir, path.Base(fi.Filename))] = fi
+	}
+
+	i.mu.Lock()
+	for _, child := range i.children[dir] {
+		name := path.Join(dir, child)
+		if _, ok := current[name]; !ok {
+			changed = append(changed, i.removeLocked(name)...)
+		}
+	}
+	newDirs := []string{}
+	names := []string{}
+	for name, fi := range current {
+		old, ok := i.entries[name]
+		if !ok || old.IsDir != fi.IsDir || old.Size != fi.Size || !old.Time.Equal(fi.Time) {
+			changed = append(changed, name)
+			if fi.IsDir && (!ok || !old.IsDir) {
+				newDirs = append(newDirs, name)
+			}
+		} else if _, failed := i.failed[name]; failed && fi.IsDir {
+			newDirs = append(newDirs, name)
+		}
+		i.entries[name] = fi
+		names = append(names, path.Base(name))
+	}
+	sort.Strings(names)
+	i.children[dir] = names
+	i.mu.Unlock()
+
+	for _, d := range newDirs {
+		entries, children, failed := i.walk(d, current[d], i.watch)
+		i.mu.Lock()
+		delete(i.failed, d)
+		changed = append(changed, i.addLocked(entries, children, failed)...)
+		i.mu.Unlock()
+	}
+
+	i.notify(changed)
+}
+
+// reload walks the directory dir again and replaces all the entries
+// under it.
+func (i *Index) reload(dir string) {
+	i.mu.RLock()
+	ready := i.ready
+	i.mu.RUnlock()
+	if !ready {
+		return
+	}
+
+	fi, err := i.Files.Stat(dir)
+	if err != nil || !fi.IsDir {
+		i.refresh(parent(dir))
+		return
+	}
+	entries, children, failed := i.walk(dir, fi, i.watch)
+
+	i.mu.Lock()
+	changed := []string{}
+	for _, child := range i.children[dir] {
+		changed = append(changed, i.removeLocked(path.Join(dir, child))...)
+	}
+	delete(i.children, dir)
+	delete(i.failed, dir)
+	i.entries[dir] = fi
+	changed = append(changed, i.addLocked(entries, children, failed)...)
+	i.mu.Unlock()
+
+	i.notify(changed)
+}
+
+// addLocked adds the result of a walk to the index, and returns the
+// names of the entries added.
+func (i *Index) addLocked(entries map[string]FileInfo, children map[string][]string, failed map[string]error) []string {
+	added := []string{}
+	for name, fi := range entries {
+		i.entries[name] = fi
+		added = append(added, name)
+	}
+	for name, c := range children {
+		i.children[name] = c
+	}
+	for name, err := range failed {
+		i.failed[name] = err
+	}
+	return added
+}
+
+// removeLocked removes name and its descendants from the index, and
+// returns their names.
+func (i *Index) removeLocked(name string) []string {
+	removed := []string{}
+	if _, ok := i.entries[name]; !ok {
+		return removed
+	}
+
+	for _, child := range i.children[name] {
+		removed = append(removed, i.removeLocked(path.Join(name, child))...)
+	}
+	delete(i.children, name)
+	delete(i.entries, name)
+	delete(i.failed, name)
+	removed = append(removed, name)
+
+	parent := path.Dir(name)
+	children := i.children[parent]
+	for j, child := range children {
+		if child == path.Base(name) {
+			i.children[parent] = append(children[:j:j], children[j+1:]...)
+			break
+		}
+	}
+
+	return removed
+}
+
+func (i *Index) notify(names []string) {
+	if i.OnChange == nil {
+		return
+	}
+	for _, name := range names {
+		i.OnChange(name)
+	}
+}
+
+// walkAll walks the whole tree. It fails if the root can't be listed.
+func (i *Index) walkAll(visit func(dir string)) (map[string]FileInfo, map[string][]string, map[string]error, error) {
+	root, err := i.Files.Stat("/")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	entries, children, failed := i.walk("/", root, visit)
+	if err, ok := failed["/"]; ok {
+		return nil, nil, nil, err
+	}
+	entries["/"] = root
+
+	return entries, children, failed, nil
+}
+
+// walk returns the entries under dir, of FileInfo fi, the sorted names
+// of the children of dir and its subdirectories, and the errors of the
+// directories that could not be listed. If set, visit is called with
+// each directory before it is listed.
+//
+// The symbolic links to a directory being walked are kept, but not
+// walked through, so that a link to a parent doesn't loop.
+func (i *Index) walk(dir string, fi FileInfo, visit func(dir string)) (map[string]FileInfo, map[string][]string, map[string]error) {
+	entries := map[string]FileInfo{}
+	children := map[string][]string{}
+	failed := map[string]error{}
+	walking := map[fileID]bool{}
+
+	var walk func(dir string, fi FileInfo)
+	walk = func(dir string, fi FileInfo) {
+		// Files without an inode number can't be told apart.
+		id := fileID{dev: fi.Dev, ino: fi.Ino}
+		if fi.Ino != 0 {
+			if walking[id] {
+				return
+			}
+			walking[id] = true
+			defer delete(walking, id)
+		}
+
+		if visit != nil {
+			visit(dir)
+		}
+		fis, err := i.Files.List(dir)
+		if err != nil {
+			failed[dir] = err
+			return
+		}
+
+		names := []string{}
+		for _, fi := range fis {
+			name := path.Join(dir, path.Base(fi.Filename))
+			entries[name] = fi
+			names = append(names, path.Base(name))
+			if fi.IsDir {
+				walk(name, fi)
+			}
+		}
+		sort.Strings(names)
+		children[dir] = names
+	}
+	walk(dir, fi)
+
+	return entries, children, failed
+}
+
+// watch adds the directory dir of each root to the watched ones.
+func (i *Index) watch(dir string) {
+	i.mu.RLock()
+	w := i.watcher
+	i.mu.RUnlock()
+	if w == nil {
+		return
+	}
+
+	for _, root := range i.Roots {
+		hostname := filepath.Join(root, filepath.FromSlash(dir))
+		if fi, err := os.Stat(hostname); err == nil && fi.IsDir() {
+			w.Add(hostname)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package local
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// indexFiles are the files of the trees indexed in the tests.
+var indexFiles = map[string]string{
+	"abc":         "hello world!\n",
+	"subdir/fgh":  "\n",
+	"subdir/deep": "",
+}
+
+func TestIndexServesFromMemory(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, indexFiles)
+	i := &Index{
+		Files: &Storage{Root: root},
+		Roots: []string{root},
+	}
+	defer i.Close()
+
+	require.NoError(t, i.Build())
+	assert.True(t, i.Ready())
+
+	require.NoError(t, os.Remove(filepath.Join(root, "abc")))
+
+	fi, err := i.Stat("abc")
+	assert.NoError(t, err)
+	assert.Equal(t, "/abc", fi.Filename)
+	assert.Equal(t, int64(13), fi.Size)
+
+	fis, err := i.List("/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/abc", "/subdir"}, filenames(fis))
+
+	fis, err = i.List("/subdir")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/subdir/deep", "/subdir/fgh"}, filenames(fis))
+
+	_, err = i.Stat("unknown")
+	assert.Error(t, err)
+	_, err = i.List("abc")
+	assert.Error(t, err)
+}
+
+func TestIndexCheck(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, indexFiles)
+	i := &Index{
+		Files: &Storage{Root: root},
+		Roots: []string{root},
+	}
+	defer i.Close()
+
+	require.NoError(t, i.Build())
+
+	diffs, err := i.Check()
+	assert.NoError(t, err)
+	assert.Empty(t, diffs)
+
+	require.NoError(t, os.Remove(filepath.Join(root, "abc")))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "new"), nil, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "subdir", "fgh"), []byte("longer\n"), 0644))
+
+	diffs, err = i.Check()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"/: stale in the index",
+		"/abc: deleted but still in the index",
+		"/new: missing from the index",
+		"/subdir/fgh: stale in the index",
+	}, diffs)
+}
+
+func TestIndexSnapshot(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, indexFiles)
+	i := &Index{
+		Files: &Storage{Root: root},
+		Roots: []string{root},
+	}
+	defer i.Close()
+
+	require.NoError(t, i.Build())
+
+	snapshot := filepath.Join(root, "snapshot")
+	require.NoError(t, i.Save(snapshot))
+
+	loaded := &Index{Files: i.Files}
+	assert.False(t, loaded.Ready())
+	require.NoError(t, loaded.Load(snapshot))
+	assert.True(t, loaded.Ready())
+
+	fis, err := loaded.List("/subdir")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/subdir/deep", "/subdir/fgh"}, filenames(fis))
+
+	assert.Error(t, loaded.Load(filepath.Join(root, "abc")))
+}
+
+func TestIndexWatch(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, indexFiles)
+	i := &Index{
+		Files: &Storage{Root: root},
+		Roots: []string{root},
+	}
+	defer i.Close()
+
+	changed := make(chan string, 100)
+	i.OnChange = func(name string) { changed <- name }
+
+	require.NoError(t, i.Watch())
+	require.NoError(t, i.Build())
+
+	require.NoError(t, os.Mkdir(filepath.Join(root, "subdir", "new"), 0755))
+	waitForChange(t, changed, "/subdir/new")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "subdir", "new", "file"), nil, 0644))
+	waitForChange(t, changed, "/subdir/new/file")
+	require.NoError(t, os.RemoveAll(filepath.Join(root, "subdir")))
+	waitForChange(t, changed, "/subdir")
+
+	fis, err := i.List("/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/abc"}, filenames(fis))
+	_, err = i.Stat("subdir/new/file")
+	assert.Error(t, err)
+}
+
+func waitForChange(t *testing.T, changed chan string, name string) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case c := <-changed:
+			if c == name {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no change seen for %q", name)
+		}
+	}
+}
+
+// listingFiles calls onList before listing each directory.
+type listingFiles struct {
+	Files
+	onList func(dir string)
+}
+
+func (l *listingFiles) List(pattern string) ([]FileInfo, error) {
+	l.onList(pattern)
+	return l.Files.List(pattern)
+}
+
+func TestIndexSeesChangesDuringBuild(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, indexFiles)
+	i := &Index{
+		Files: &Storage{Root: root},
+		Roots: []string{root},
+	}
+	defer i.Close()
+
+	// The root is already listed when the file is created.
+	created := false
+	i.Files = &listingFiles{Files: i.Files, onList: func(dir string) {
+		if dir == "/subdir" && !created {
+			created = true
+			require.NoError(t, ioutil.WriteFile(filepath.Join(root, "late"), nil, 0644))
+			time.Sleep(100 * time.Millisecond)
+		}
+	}}
+
+	changed := make(chan string, 100)
+	i.OnChange = func(name string) { changed <- name }
+
+	require.NoError(t, i.Watch())
+	require.NoError(t, i.Build())
+	waitForChange(t, changed, "/late")
+
+	_, err := i.Stat("late")
+	assert.NoError(t, err)
+}
+
+func TestIndexDoesNotFollowLinkLoops(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "d", "e"), 0755))
+	require.NoError(t, os.Symlink("..", filepath.Join(root, "d", "up")))
+	require.NoError(t, os.Symlink("..", filepath.Join(root, "d", "e", "up")))
+
+	i := &Index{Files: &Storage{Root: root}}
+	require.NoError(t, i.Build())
+
+	fi, err := i.Stat("d/up")
+	require.NoError(t, err)
+	assert.True(t, fi.IsDir)
+	_, err = i.Stat("d/up/d")
+	assert.Error(t, err, "the link to a parent is not walked through")
+	_, err = i.Stat("d/e/up/e")
+	assert.Error(t, err)
+}
+
+// failingFiles fails to list the directory dir.
+type failingFiles struct {
+	Files
+	dir string
+}
+
+func (f *failingFiles) List(pattern string) ([]FileInfo, error) {
+	if filepath.Clean("/"+pattern) == f.dir {
+		return nil, os.ErrPermission
+	}
+	return f.Files.List(pattern)
+}
+
+func TestIndexLeavesOutUnreadableDirectories(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "closed", "sub"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "open.txt"), nil, 0644))
+
+	i := &Index{Files: &failingFiles{Files: &Storage{Root: root}, dir: "/closed"}}
+	require.NoError(t, i.Build())
+
+	assert.True(t, i.Ready())
+	assert.Equal(t, map[string]error{"/closed": os.ErrPermission}, i.Unreadable())
+	_, err := i.Stat("open.txt")
+	assert.NoError(t, err)
+	_, err = i.Stat("closed")
+	assert.NoError(t, err)
+	_, err = i.List("closed")
+	assert.Equal(t, os.ErrPermission, err)
+
+	// The root itself must be readable.
+	i = &Index{Files: &failingFiles{Files: &Storage{Root: root}, dir: "/"}}
+	assert.Error(t, i.Build())
+}
+
+func TestIndexAppliesIgnoreFileChanges(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(root, "sub"), 0755))
+	for _, name := range []string{"top.txt", "sub/secret.txt", "sub/public.txt"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, name), nil, 0644))
+	}
+
+	i := &Index{
+		Files: &Filter{Files: &Storage{Root: root}},
+		Roots: []string{root},
+	}
+	defer i.Close()
+	require.NoError(t, i.Watch())
+	require.NoError(t, i.Build())
+	_, err := i.Stat("sub/secret.txt")
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, IgnoreFile), []byte("secret.txt\ntop.txt\n"), 0644))
+
+	assert.Eventually(t, func() bool {
+		_, err1 := i.Stat("top.txt")
+		_, err2 := i.Stat("sub/secret.txt")
+		return err1 != nil && err2 != nil
+	}, time.Second, 10*time.Millisecond)
+
+	fis, err := i.List("sub")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/sub/public.txt"}, filenames(fis))
+}
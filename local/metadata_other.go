@@ -0,0 +1,12 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package local
+
+import "os"
+
+// setMetadata fills the fields of info only available on Unix systems
+// from fi. Only the mode is known on this system.
+func setMetadata(info *FileInfo, fi os.FileInfo) {
+	info.Mode = fi.Mode()
+}
@@ -0,0 +1,25 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package local
+
+import (
+	"os"
+	"syscall"
+)
+
+// setMetadata fills the fields of info only available on Unix systems
+// from fi.
+func setMetadata(info *FileInfo, fi os.FileInfo) {
+	info.Mode = fi.Mode()
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+
+	info.Uid = st.Uid
+	info.Gid = st.Gid
+	info.Ino = uint64(st.Ino)
+	info.Dev = uint64(st.Dev)
+}
@@ -0,0 +1,301 @@
+package local
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// whiteoutPrefix is prepended to the name of a file of the upper
+	// layer to record that the entry with the same name in the lower
+	// layers has been deleted.
+	whiteoutPrefix = ".wh."
+
+	// opaqueMarker is the name of a whiteout file placed in a directory
+	// of the upper layer to hide the whole content of the lower layers
+	// for that directory.
+	opaqueMarker = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// Overlay is a union of several Storages. Reads are served from the
+// first layer holding the file, starting with Upper; writes and
+// deletions only ever touch Upper, deletions of files from the lower
+// layers being recorded as whiteouts.
+//
+// The server is read-only and only reads through the Overlay. WriteFile,
+// Mkdir and Remove are for the programs using this package to change
+// the upper layer, which the server then serves.
+type Overlay struct {
+	Upper *Storage
+	Lower []*Storage
+
+	// Key, if set, encrypts the files of Upper as Encrypted does. The
+	// lower layers are served as they are. The plaintext files already
+	// in Upper can't be read, see CheckEncrypted.
+	Key []byte
+}
+
+func (o *Overlay) Open(name string) (File, error) {
+	for _, l := range o.layers(name) {
+		if _, err := os.Lstat(l.filename(name)); err != nil {
+			continue
+		}
+		return o.files(l).Open(name)
+	}
+
+	return nil, errors.Wrapf(notExist("open", name), "could not open file %q", name)
+}
+
+func (o *Overlay) Stat(name string) (FileInfo, error) {
+	for _, l := range o.layers(name) {
+		if _, err := os.Lstat(l.filename(name)); err != nil {
+			continue
+		}
+		return o.files(l).Stat(name)
+	}
+
+	return FileInfo{}, errors.Wrapf(notExist("stat", name), "could not stat file %q", name)
+}
+
+func (o *Overlay) List(pattern string) ([]FileInfo, error) {
+	layers := o.layers(pattern)
+	if len(layers) == 0 {
+		return nil, errors.Wrap(notExist("readdir", pattern), "error reading dir")
+	}
+
+	infos := []FileInfo{}
+	seen := map[string]bool{}
+	found := false
+	var lastErr error
+
+	for _, l := range layers {
+		fis, err := o.files(l).List(pattern)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		found = true
+
+		for _, fi := range fis {
+			base := filepath.Base(fi.Filename)
+			if seen[base] {
+				continue
+			}
+			seen[base] = true
+			if strings.HasPrefix(base, whiteoutPrefix) {
+				seen[strings.TrimPrefix(base, whiteoutPrefix)] = true
+				continue
+			}
+			infos = append(infos, fi)
+		}
+
+		if l == o.Upper && o.isOpaque(pattern) {
+			break
+		}
+	}
+
+	if !found {
+		return nil, lastErr
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Filename < infos[j].Filename
+	})
+
+	return infos, nil
+}
+
+// WriteFile writes data to the file name of the upper layer, creating
+// its parent directories if needed. It is not used by the server.
+func (o *Overlay) WriteFile(name string, data []byte) error {
+	if err := o.Mkdir(filepath.Dir(filepath.Clean("/" + name))); err != nil {
+		return err
+	}
+
+	var err error
+	if o.Key != nil {
+		err = o.files(o.Upper).(*Encrypted).WriteFile(name, data)
+	} else {
+		err = o.Upper.WriteFile(name, data)
+	}
+	if err != nil {
+		return err
+	}
+
+	return o.removeWhiteout(name)
+}
+
+// Mkdir creates the directory name and its parents in the upper layer.
+// A directory created where a deleted one used to be is made opaque so
+// that the deleted content of the lower layers does not reappear.
+func (o *Overlay) Mkdir(name string) error {
+	clean := filepath.Clean("/" + name)
+	if clean == "/" {
+		return nil
+	}
+
+	if err := o.Mkdir(filepath.Dir(clean)); err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(o.Upper.filename(clean))
+	if err == nil {
+		if !fi.IsDir() {
+			return errors.Errorf("could not create directory %q: not a directory", name)
+		}
+		return nil
+	}
+
+	wasDeleted := o.hasWhiteout(clean)
+
+	if err := os.Mkdir(o.Upper.filename(clean), 0755); err != nil {
+		return errors.Wrapf(err, "could not create directory %q", name)
+	}
+
+	if wasDeleted {
+		err := ioutil.WriteFile(
+			filepath.Join(o.Upper.filename(clean), opaqueMarker), nil, 0644)
+		if err != nil {
+			return errors.Wrapf(err, "could not make directory %q opaque", name)
+		}
+	}
+
+	return o.removeWhiteout(clean)
+}
+
+// Remove deletes the file or empty directory name. It is removed from
+// the upper layer and hidden from the lower layers by a whiteout.
+func (o *Overlay) Remove(name string) error {
+	fi, err := o.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	if fi.IsDir {
+		fis, err := o.List(name)
+		if err != nil {
+			return err
+		}
+		if len(fis) > 0 {
+			return errors.Errorf("could not remove directory %q: not empty", name)
+		}
+	}
+
+	upper := o.Upper.filename(name)
+	if _, err := os.Lstat(upper); err == nil {
+		if err := os.RemoveAll(upper); err != nil {
+			return errors.Wrapf(err, "could not remove %q", name)
+		}
+	}
+
+	for _, l := range o.Lower {
+		if _, err := os.Lstat(l.filename(name)); err != nil {
+			continue
+		}
+		if err := o.Mkdir(filepath.Dir(filepath.Clean("/" + name))); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(o.whiteout(name), nil, 0644); err != nil {
+			return errors.Wrapf(err, "could not remove %q", name)
+		}
+		break
+	}
+
+	return nil
+}
+
+// CheckEncrypted returns an error if Key is set and a file of the upper
+// layer is not encrypted, as it could not be read.
+func (o *Overlay) CheckEncrypted() error {
+	if o.Key == nil {
+		return nil
+	}
+
+	return filepath.Walk(o.Upper.Root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if path == o.Upper.Root && os.IsNotExist(err) {
+				return nil
+			}
+			return errors.Wrapf(err, "could not check %q", path)
+		}
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), whiteoutPrefix) {
+			return nil
+		}
+
+		ok, err := isEncrypted(path)
+		if err != nil {
+			return errors.Wrapf(err, "could not check %q", path)
+		}
+		if !ok {
+			return errors.Errorf("file %q of the upper directory is not encrypted", path)
+		}
+		return nil
+	})
+}
+
+// files returns the files of the layer l, decrypted if it is the upper
+// one and Key is set.
+func (o *Overlay) files(l *Storage) Files {
+	if l == o.Upper && o.Key != nil {
+		return &Encrypted{Files: l, Key: o.Key}
+	}
+	return l
+}
+
+// layers returns the layers that may hold name, taking into account the
+// whiteouts and opaque directories of the upper layer along its path.
+func (o *Overlay) layers(name string) []*Storage {
+	clean := filepath.Clean("/" + name)
+
+	for p := clean; p != "/"; p = filepath.Dir(p) {
+		if o.hasWhiteout(p) {
+			return nil
+		}
+	}
+
+	layers := []*Storage{o.Upper}
+	for p := clean; ; p = filepath.Dir(p) {
+		if o.isOpaque(p) {
+			return layers
+		}
+		if p == "/" {
+			break
+		}
+	}
+
+	return append(layers, o.Lower...)
+}
+
+func (o *Overlay) whiteout(name string) string {
+	clean := filepath.Clean("/" + name)
+	return o.Upper.filename(
+		filepath.Join(filepath.Dir(clean), whiteoutPrefix+filepath.Base(clean)))
+}
+
+func (o *Overlay) hasWhiteout(name string) bool {
+	_, err := os.Lstat(o.whiteout(name))
+	return err == nil
+}
+
+func (o *Overlay) removeWhiteout(name string) error {
+	err := os.Remove(o.whiteout(name))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "could not remove whiteout of %q", name)
+	}
+
+	return nil
+}
+
+func (o *Overlay) isOpaque(name string) bool {
+	_, err := os.Lstat(filepath.Join(o.Upper.filename(name), opaqueMarker))
+	return err == nil
+}
+
+func notExist(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
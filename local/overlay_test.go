@@ -0,0 +1,238 @@
+package local
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// overlayFiles are the files of the lower and upper layers of the
+// overlays tested.
+var overlayFiles = map[string]string{
+	"lower/base.txt":        "base",
+	"lower/shared.txt":      "lower",
+	"lower/subdir/deep.txt": "deep",
+	"upper/shared.txt":      "upper",
+	"upper/added.txt":       "added",
+}
+
+// writeFiles writes the files, by name relative to root, and their
+// parent directories.
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		p := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, ioutil.WriteFile(p, []byte(content), 0644))
+	}
+}
+
+func readOverlayFile(t *testing.T, o *Overlay, name string) string {
+	f, err := o.Open(name)
+	require.NoError(t, err)
+	defer f.Close()
+	bytes, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	return string(bytes)
+}
+
+func filenames(fis []FileInfo) []string {
+	names := []string{}
+	for _, fi := range fis {
+		names = append(names, fi.Filename)
+	}
+	return names
+}
+
+func TestOverlayOpenPrefersUpper(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, overlayFiles)
+	o := &Overlay{
+		Upper: &Storage{Root: filepath.Join(root, "upper")},
+		Lower: []*Storage{{Root: filepath.Join(root, "lower")}},
+	}
+
+	assert.Equal(t, "upper", readOverlayFile(t, o, "shared.txt"))
+	assert.Equal(t, "base", readOverlayFile(t, o, "base.txt"))
+	assert.Equal(t, "added", readOverlayFile(t, o, "added.txt"))
+	assert.Equal(t, "deep", readOverlayFile(t, o, "subdir/deep.txt"))
+}
+
+func TestOverlayStat(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, overlayFiles)
+	o := &Overlay{
+		Upper: &Storage{Root: filepath.Join(root, "upper")},
+		Lower: []*Storage{{Root: filepath.Join(root, "lower")}},
+	}
+
+	fi, err := o.Stat("shared.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "/shared.txt", fi.Filename)
+	assert.Equal(t, int64(5), fi.Size)
+
+	fi, err = o.Stat("subdir")
+	assert.NoError(t, err)
+	assert.True(t, fi.IsDir)
+
+	_, err = o.Stat("unknown.txt")
+	assert.Error(t, err)
+}
+
+func TestOverlayListMerges(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, overlayFiles)
+	o := &Overlay{
+		Upper: &Storage{Root: filepath.Join(root, "upper")},
+		Lower: []*Storage{{Root: filepath.Join(root, "lower")}},
+	}
+
+	fis, err := o.List("/")
+	assert.NoError(t, err)
+	assert.Equal(t,
+		[]string{"/added.txt", "/base.txt", "/shared.txt", "/subdir"},
+		filenames(fis))
+
+	_, err = o.List("unknown_dir")
+	assert.Error(t, err)
+}
+
+func TestOverlayWriteFile(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, overlayFiles)
+	o := &Overlay{
+		Upper: &Storage{Root: filepath.Join(root, "upper")},
+		Lower: []*Storage{{Root: filepath.Join(root, "lower")}},
+	}
+
+	require.NoError(t, o.WriteFile("base.txt", []byte("replaced")))
+	require.NoError(t, o.WriteFile("subdir/new.txt", []byte("new")))
+
+	assert.Equal(t, "replaced", readOverlayFile(t, o, "base.txt"))
+	assert.Equal(t, "new", readOverlayFile(t, o, "subdir/new.txt"))
+
+	lower, err := ioutil.ReadFile(o.Lower[0].filename("base.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "base", string(lower))
+	_, err = os.Stat(o.Lower[0].filename("subdir/new.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestOverlayRemoveRecordsWhiteout(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, overlayFiles)
+	o := &Overlay{
+		Upper: &Storage{Root: filepath.Join(root, "upper")},
+		Lower: []*Storage{{Root: filepath.Join(root, "lower")}},
+	}
+
+	require.NoError(t, o.Remove("shared.txt"))
+	require.NoError(t, o.Remove("base.txt"))
+
+	_, err := o.Stat("shared.txt")
+	assert.Error(t, err)
+	_, err = o.Open("base.txt")
+	assert.Error(t, err)
+
+	fis, err := o.List("/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/added.txt", "/subdir"}, filenames(fis))
+
+	_, err = os.Stat(o.Lower[0].filename("base.txt"))
+	assert.NoError(t, err)
+
+	require.NoError(t, o.WriteFile("base.txt", []byte("again")))
+	assert.Equal(t, "again", readOverlayFile(t, o, "base.txt"))
+}
+
+func TestOverlayRemoveDirectory(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, overlayFiles)
+	o := &Overlay{
+		Upper: &Storage{Root: filepath.Join(root, "upper")},
+		Lower: []*Storage{{Root: filepath.Join(root, "lower")}},
+	}
+
+	assert.Error(t, o.Remove("subdir"))
+
+	require.NoError(t, o.Remove("subdir/deep.txt"))
+	require.NoError(t, o.Remove("subdir"))
+
+	_, err := o.Stat("subdir/deep.txt")
+	assert.Error(t, err)
+
+	require.NoError(t, o.Mkdir("subdir"))
+	fis, err := o.List("subdir")
+	assert.NoError(t, err)
+	assert.Empty(t, fis)
+}
+
+func TestOverlayEncryptsOnlyUpper(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, overlayFiles)
+	o := &Overlay{
+		Upper: &Storage{Root: filepath.Join(root, "upper")},
+		Lower: []*Storage{{Root: filepath.Join(root, "lower")}},
+	}
+	o.Key = bytes.Repeat([]byte{42}, 32)
+
+	// The files already in the upper layer are plaintext, replace them.
+	require.NoError(t, o.WriteFile("shared.txt", []byte("upper")))
+	require.NoError(t, o.WriteFile("subdir/written.txt", []byte("written")))
+
+	onDisk, err := ioutil.ReadFile(filepath.Join(o.Upper.Root, "subdir/written.txt"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(onDisk), "written")
+
+	assert.Equal(t, "upper", readOverlayFile(t, o, "shared.txt"))
+	assert.Equal(t, "written", readOverlayFile(t, o, "subdir/written.txt"))
+	assert.Equal(t, "base", readOverlayFile(t, o, "base.txt"))
+	assert.Equal(t, "deep", readOverlayFile(t, o, "subdir/deep.txt"))
+
+	fi, err := o.Stat("base.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len("base")), fi.Size)
+	fi, err = o.Stat("subdir/written.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len("written")), fi.Size)
+
+	fis, err := o.List("subdir")
+	require.NoError(t, err)
+	sizes := map[string]int64{}
+	for _, fi := range fis {
+		sizes[fi.Filename] = fi.Size
+	}
+	assert.Equal(t, map[string]int64{
+		"subdir/deep.txt":    int64(len("deep")),
+		"subdir/written.txt": int64(len("written")),
+	}, sizes)
+}
+
+func TestOverlayCheckEncrypted(t *testing.T) {
+	upper := t.TempDir()
+	o := &Overlay{
+		Upper: &Storage{Root: upper},
+		Lower: []*Storage{{Root: t.TempDir()}},
+		Key:   bytes.Repeat([]byte{42}, 32),
+	}
+
+	require.NoError(t, o.WriteFile("subdir/written.txt", []byte("written")))
+	require.NoError(t, o.WriteFile("empty", nil))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(upper, ".wh.deleted"), nil, 0644))
+	assert.NoError(t, o.CheckEncrypted())
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(upper, "subdir", "plain.txt"), []byte("plain"), 0644))
+	assert.Error(t, o.CheckEncrypted())
+
+	o.Key = nil
+	assert.NoError(t, o.CheckEncrypted())
+
+	// A missing upper directory holds no plaintext files.
+	o.Key = bytes.Repeat([]byte{42}, 32)
+	o.Upper.Root = filepath.Join(upper, "missing")
+	assert.NoError(t, o.CheckEncrypted())
+}
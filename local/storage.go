@@ -1,6 +1,7 @@
 package local
 
 import (
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -20,13 +21,31 @@ type FileInfo struct {
 	IsDir    bool
 	Size     int64
 	Time     time.Time
+
+	// Mode holds the permission and type bits of the file.
+	Mode os.FileMode
+	// Uid and Gid are the numeric ids of the owner of the file.
+	Uid, Gid uint32
+	// Ino and Dev identify the file on the host, so that hard links
+	// can be recognized.
+	Ino, Dev uint64
+	// Link is the target of the file if it is a symbolic link.
+	Link string
+}
+
+// File is an open file of a Storage.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Closer
+	Stat() (os.FileInfo, error)
 }
 
 func (fi FileInfo) Path() string {
 	return filepath.Join(fi.Dir, fi.Filename)
 }
 
-func (s *Storage) Open(name string) (*os.File, error) {
+func (s *Storage) Open(name string) (File, error) {
 	f, err := os.Open(s.filename(name))
 	if err != nil {
 		return nil, errors.Wrapf(err, "could not open file %q", name)
@@ -35,25 +54,34 @@ func (s *Storage) Open(name string) (*os.File, error) {
 	return f, nil
 }
 
+// Stat returns the FileInfo of the file name. Symbolic links are
+// followed, the FileInfo being that of their target along with Link.
 func (s *Storage) Stat(name string) (FileInfo, error) {
 	f, err := os.Open(s.filename(name))
 	if err != nil {
 		return FileInfo{}, errors.Wrapf(err, "could not open file %q", name)
 	}
+	defer f.Close()
 	fi, err := f.Stat()
 	if err != nil {
 		return FileInfo{}, errors.Wrapf(err, "could not stat file %q", name)
 	}
 
-	return FileInfo{
-		Filename: strings.TrimPrefix(s.filename(name), s.Root),
-		Dir:      strings.TrimPrefix(s.dir(name), s.Root),
-		IsDir:    fi.IsDir(),
-		Size:     fi.Size(),
-		Time:     fi.ModTime(),
-	}, nil
+	link := ""
+	lfi, err := os.Lstat(s.filename(name))
+	if err == nil && lfi.Mode()&os.ModeSymlink != 0 {
+		link, _ = os.Readlink(s.filename(name))
+	}
+
+	return fileInfo(
+		strings.TrimPrefix(s.filename(name), s.Root),
+		strings.TrimPrefix(s.dir(name), s.Root),
+		fi, link), nil
 }
 
+// List returns the FileInfos of the files of the directory pattern,
+// following the symbolic links as Stat does. Links whose target does not
+// exist, which Stat fails on, are listed as they are.
 func (s *Storage) List(pattern string) ([]FileInfo, error) {
 	fis, err := ioutil.ReadDir(s.filename(pattern))
 	if err != nil {
@@ -63,18 +91,52 @@ func (s *Storage) List(pattern string) ([]FileInfo, error) {
 	infos := []FileInfo{}
 
 	for _, fi := range fis {
-		infos = append(infos, FileInfo{
-			Filename: filepath.Join(pattern, fi.Name()),
-			Dir:      s.dir(pattern),
-			IsDir:    fi.IsDir(),
-			Size:     fi.Size(),
-			Time:     fi.ModTime(),
-		})
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			p := filepath.Join(s.filename(pattern), fi.Name())
+			link, _ = os.Readlink(p)
+			if target, err := os.Stat(p); err == nil {
+				fi = target
+			}
+		}
+
+		infos = append(infos, fileInfo(
+			filepath.Join(pattern, fi.Name()), s.dir(pattern), fi, link))
 	}
 
 	return infos, nil
 }
 
+// fileInfo returns the FileInfo of the file filename of the directory
+// dir, of os.FileInfo fi, being a symbolic link to link if set.
+func fileInfo(filename, dir string, fi os.FileInfo, link string) FileInfo {
+	info := FileInfo{
+		Filename: filename,
+		Dir:      dir,
+		IsDir:    fi.IsDir(),
+		Size:     fi.Size(),
+		Time:     fi.ModTime(),
+		Link:     link,
+	}
+	setMetadata(&info, fi)
+
+	return info
+}
+
+// WriteFile writes data to the file name, creating its parent
+// directories if needed.
+func (s *Storage) WriteFile(name string, data []byte) error {
+	if err := os.MkdirAll(s.dir(name), 0755); err != nil {
+		return errors.Wrapf(err, "could not create directory of %q", name)
+	}
+
+	if err := ioutil.WriteFile(s.filename(name), data, 0644); err != nil {
+		return errors.Wrapf(err, "could not write file %q", name)
+	}
+
+	return nil
+}
+
 func (s *Storage) filename(name string) string {
 	return filepath.Join(s.Root, filepath.FromSlash(filepath.Clean("/"+name)))
 }
@@ -2,10 +2,13 @@ package local
 
 import (
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestOpenOK(t *testing.T) {
@@ -97,7 +100,7 @@ func TestStatOK(t *testing.T) {
 	for in, expected := range cases {
 		fi, err := s.Stat(in)
 		assert.NoError(t, err)
-		assert.Equal(t, expected, fi)
+		assert.Equal(t, expected, withoutMetadata(fi))
 	}
 }
 
@@ -157,6 +160,9 @@ func TestListOK(t *testing.T) {
 	for in, expected := range cases {
 		fis, err := s.List(in)
 		assert.NoError(t, err)
+		for i := range fis {
+			fis[i] = withoutMetadata(fis[i])
+		}
 		assert.Equal(t, expected, fis)
 	}
 }
@@ -177,6 +183,99 @@ func TestListNotFound(t *testing.T) {
 	}
 }
 
+func TestStatMetadata(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "metadata")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	target := filepath.Join(tmp, "target")
+	require.NoError(t, ioutil.WriteFile(target, []byte("abc"), 0600))
+	require.NoError(t, os.Chmod(target, 0640))
+	require.NoError(t, os.Symlink("target", filepath.Join(tmp, "link")))
+	require.NoError(t, os.Link(target, filepath.Join(tmp, "hardlink")))
+
+	s := &Storage{tmp}
+
+	fi, err := s.Stat("target")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), fi.Mode)
+	assert.Equal(t, uint32(os.Getuid()), fi.Uid)
+	assert.Equal(t, uint32(os.Getgid()), fi.Gid)
+	assert.NotZero(t, fi.Ino)
+	assert.Empty(t, fi.Link)
+
+	link, err := s.Stat("link")
+	assert.NoError(t, err)
+	assert.Equal(t, "target", link.Link)
+	assert.Equal(t, int64(3), link.Size)
+
+	hardlink, err := s.Stat("hardlink")
+	assert.NoError(t, err)
+	assert.Equal(t, fi.Ino, hardlink.Ino)
+	assert.Equal(t, fi.Dev, hardlink.Dev)
+
+	fis, err := s.List("/")
+	assert.NoError(t, err)
+	require.Len(t, fis, 3)
+	assert.Equal(t, "/link", fis[1].Filename)
+	assert.Equal(t, "target", fis[1].Link)
+	assert.Equal(t, os.FileMode(0640), fis[1].Mode)
+	assert.Equal(t, fi.Ino, fis[2].Ino)
+}
+
+func TestStatAndListAgreeOnSymlinks(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "symlinks")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "target"), []byte("abcdef"), 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(tmp, "dir"), 0755))
+	require.NoError(t, os.Symlink("target", filepath.Join(tmp, "link")))
+	require.NoError(t, os.Symlink("dir", filepath.Join(tmp, "dirlink")))
+	require.NoError(t, os.Symlink("missing", filepath.Join(tmp, "broken")))
+
+	s := &Storage{tmp}
+
+	fis, err := s.List("/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/broken", "/dir", "/dirlink", "/link", "/target"}, filenames(fis))
+
+	// Broken links are listed as they are, for them to be reported.
+	assert.Equal(t, "missing", fis[0].Link)
+	assert.Equal(t, os.ModeSymlink, fis[0].Mode&os.ModeSymlink)
+
+	for _, listed := range fis[1:] {
+		stated, err := s.Stat(listed.Filename)
+		require.NoError(t, err)
+		assert.Equal(t, stated.IsDir, listed.IsDir, listed.Filename)
+		assert.Equal(t, stated.Size, listed.Size, listed.Filename)
+		assert.Equal(t, stated.Time, listed.Time, listed.Filename)
+		assert.Equal(t, stated.Mode, listed.Mode, listed.Filename)
+		assert.Equal(t, stated.Ino, listed.Ino, listed.Filename)
+		assert.Equal(t, stated.Link, listed.Link, listed.Filename)
+	}
+
+	link, err := s.Stat("link")
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), link.Size)
+	assert.Equal(t, "target", link.Link)
+	dirlink, err := s.Stat("dirlink")
+	require.NoError(t, err)
+	assert.True(t, dirlink.IsDir)
+
+	_, err = s.Stat("broken")
+	assert.Error(t, err)
+}
+
+// withoutMetadata clears the fields of fi depending on the host the
+// tests are run on.
+func withoutMetadata(fi FileInfo) FileInfo {
+	fi.Mode = 0
+	fi.Uid, fi.Gid = 0, 0
+	fi.Ino, fi.Dev = 0, 0
+	return fi
+}
+
 func TestFilename(t *testing.T) {
 	cases := map[string]string{
 		"toto":                  "a/toto",
@@ -0,0 +1,34 @@
+package logging
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// Handler serves the levels of the loggers on GET, and sets them from
+// the body of PUT requests, in the format of SetLevels.
+type Handler struct{}
+
+func (Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		spec, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := SetLevels(string(spec)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		For("logging").Info("levels changed", "levels", Levels())
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fmt.Fprintln(w, Levels())
+}
@@ -0,0 +1,206 @@
+// Package logging configures the structured, leveled loggers of the
+// server. Each package logs through its own logger, whose level can be
+// changed at runtime.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// Redacted replaces the values of the attributes holding secrets.
+const Redacted = "[REDACTED]"
+
+var (
+	mu      sync.RWMutex
+	base    slog.Handler = newHandler(os.Stderr, "logfmt")
+	deflt                = &slog.LevelVar{}
+	levels               = map[string]*slog.LevelVar{}
+	secrets              = []string{"secret", "password", "token", "factotum", "privatekey", "private_key"}
+)
+
+// Discard drops everything logged to it.
+var Discard = slog.New(discardHandler{})
+
+// Setup sets where the logs are written to, in format "json" or
+// "logfmt".
+func Setup(w io.Writer, format string) error {
+	if format != "json" && format != "logfmt" {
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	mu.Lock()
+	base = newHandler(w, format)
+	mu.Unlock()
+
+	return nil
+}
+
+// For returns the logger of the package pkg.
+func For(pkg string) *slog.Logger {
+	return slog.New(&handler{level: pkgLevel(pkg)}).With("pkg", pkg)
+}
+
+// SetLevels sets the levels from spec, a comma-separated list of levels
+// for packages as "pkg=level", and of the level of the other packages,
+// e.g. "info,dir=debug".
+func SetLevels(spec string) error {
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		pkg, name := "", part
+		if i := strings.Index(part, "="); i >= 0 {
+			pkg, name = part[:i], part[i+1:]
+		}
+
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(name)); err != nil {
+			return fmt.Errorf("invalid log level %q: %v", part, err)
+		}
+		if pkg == "" {
+			deflt.Set(l)
+			continue
+		}
+		SetLevel(pkg, l)
+	}
+
+	return nil
+}
+
+// SetLevel sets the level of the package pkg.
+func SetLevel(pkg string, l slog.Level) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := levels[pkg]; !ok {
+		levels[pkg] = &slog.LevelVar{}
+	}
+	levels[pkg].Set(l)
+}
+
+// Levels returns the current levels in the format of SetLevels.
+func Levels() string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	parts := []string{strings.ToLower(deflt.Level().String())}
+	pkgs := []string{}
+	for pkg := range levels {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	for _, pkg := range pkgs {
+		parts = append(parts, pkg+"="+strings.ToLower(levels[pkg].Level().String()))
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// pkgLevel is the level of a package, falling back to the default level
+// until one is set for it.
+type pkgLevel string
+
+func (p pkgLevel) Level() slog.Level {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if l, ok := levels[string(p)]; ok {
+		return l.Level()
+	}
+	return deflt.Level()
+}
+
+func newHandler(w io.Writer, format string) slog.Handler {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug, ReplaceAttr: redact}
+	if format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// redact replaces the values of the attributes named after secrets, and
+// of those holding keys.
+func redact(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, s := range secrets {
+		if strings.Contains(key, s) {
+			return slog.String(a.Key, Redacted)
+		}
+	}
+
+	if _, ok := a.Value.Any().(interface {
+		FileSign(hash upspin.DEHash) (upspin.Signature, error)
+	}); ok {
+		return slog.String(a.Key, Redacted)
+	}
+
+	return a
+}
+
+// handler filters the records with level and passes them to the base
+// handler at the time they are logged, so that Setup applies to the
+// loggers already created.
+type handler struct {
+	level slog.Leveler
+	// with are the calls to WithAttrs and WithGroup, in order.
+	with []func(slog.Handler) slog.Handler
+}
+
+func (h *handler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	mu.RLock()
+	b := base
+	mu.RUnlock()
+
+	for _, with := range h.with {
+		b = with(b)
+	}
+
+	return b.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.add(func(b slog.Handler) slog.Handler { return b.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.add(func(b slog.Handler) slog.Handler { return b.WithGroup(name) })
+}
+
+func (h *handler) add(with func(slog.Handler) slog.Handler) slog.Handler {
+	return &handler{
+		level: h.level,
+		with:  append(append([]func(slog.Handler) slog.Handler{}, h.with...), with),
+	}
+}
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (d discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return d }
+func (d discardHandler) WithGroup(string) slog.Handler           { return d }
+
+// ErrorKind returns the upspin kind of err, for the error kind field of
+// the logs.
+func ErrorKind(err error) string {
+	if e, ok := err.(*errors.Error); ok {
+		return e.Kind.String()
+	}
+	return errors.Other.String()
+}
@@ -0,0 +1,138 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// reset sets up the logs to be written as JSON to the returned buffer,
+// with the default levels.
+func reset(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	require.NoError(t, Setup(&buf, "json"))
+
+	mu.Lock()
+	deflt.Set(slog.LevelInfo)
+	levels = map[string]*slog.LevelVar{}
+	mu.Unlock()
+
+	return &buf
+}
+
+func records(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	records := []map[string]interface{}{}
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var r map[string]interface{}
+		require.NoError(t, dec.Decode(&r))
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestLevels(t *testing.T) {
+	buf := reset(t)
+
+	dir, store := For("dir"), For("store")
+
+	dir.Debug("hidden")
+	store.Info("shown")
+
+	require.NoError(t, SetLevels("warn,dir=debug"))
+	assert.Equal(t, "warn,dir=debug", Levels())
+
+	dir.Debug("shown")
+	store.Info("hidden")
+	store.Warn("shown")
+
+	rs := records(t, buf)
+	require.Len(t, rs, 3)
+	for _, r := range rs {
+		assert.Equal(t, "shown", r["msg"])
+	}
+	assert.Equal(t, "store", rs[0]["pkg"])
+	assert.Equal(t, "dir", rs[1]["pkg"])
+
+	assert.Error(t, SetLevels("dir=loud"))
+}
+
+func TestSetupAppliesToExistingLoggers(t *testing.T) {
+	reset(t)
+	logger := For("main")
+
+	var buf bytes.Buffer
+	require.NoError(t, Setup(&buf, "logfmt"))
+	logger.Info("hello", "user", "user@example.com")
+
+	assert.Contains(t, buf.String(), `level=INFO msg=hello pkg=main user=user@example.com`)
+	assert.Error(t, Setup(&buf, "xml"))
+}
+
+type fakeFactotum struct{}
+
+func (fakeFactotum) FileSign(hash upspin.DEHash) (upspin.Signature, error) {
+	return upspin.Signature{}, nil
+}
+
+func TestRedaction(t *testing.T) {
+	buf := reset(t)
+
+	For("main").Info("config",
+		"secrets", "/home/user/.ssh",
+		"Password", "hunter2",
+		"f", fakeFactotum{},
+		"user", "user@example.com")
+
+	rs := records(t, buf)
+	require.Len(t, rs, 1)
+	assert.Equal(t, Redacted, rs[0]["secrets"])
+	assert.Equal(t, Redacted, rs[0]["Password"])
+	assert.Equal(t, Redacted, rs[0]["f"])
+	assert.Equal(t, "user@example.com", rs[0]["user"])
+}
+
+func TestGroupsAndAttrs(t *testing.T) {
+	buf := reset(t)
+
+	For("dir").With("user", "a@example.com").WithGroup("call").Info("lookup", "path", "a@example.com/x")
+
+	rs := records(t, buf)
+	require.Len(t, rs, 1)
+	assert.Equal(t, "a@example.com", rs[0]["user"])
+	assert.Equal(t, map[string]interface{}{"path": "a@example.com/x"}, rs[0]["call"])
+}
+
+func TestHandler(t *testing.T) {
+	reset(t)
+
+	w := httptest.NewRecorder()
+	Handler{}.ServeHTTP(w, httptest.NewRequest("PUT", "/debug/log-levels", strings.NewReader("info,store=debug")))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "info,store=debug\n", w.Body.String())
+
+	w = httptest.NewRecorder()
+	Handler{}.ServeHTTP(w, httptest.NewRequest("PUT", "/debug/log-levels", strings.NewReader("store=loud")))
+	assert.Equal(t, 400, w.Code)
+
+	w = httptest.NewRecorder()
+	Handler{}.ServeHTTP(w, httptest.NewRequest("DELETE", "/debug/log-levels", nil))
+	assert.Equal(t, 405, w.Code)
+
+	w = httptest.NewRecorder()
+	Handler{}.ServeHTTP(w, httptest.NewRequest("GET", "/debug/log-levels", nil))
+	assert.Equal(t, "info,store=debug\n", w.Body.String())
+}
+
+func TestErrorKind(t *testing.T) {
+	assert.Equal(t, errors.NotExist.String(), ErrorKind(errors.E(errors.NotExist)))
+	assert.Equal(t, errors.Other.String(), ErrorKind(errors.Str("plain")))
+}
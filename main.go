@@ -1,15 +1,29 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/gildasch/upspin-localserver/audit"
 	"github.com/gildasch/upspin-localserver/dir"
+	"github.com/gildasch/upspin-localserver/health"
 	"github.com/gildasch/upspin-localserver/local"
+	"github.com/gildasch/upspin-localserver/logging"
+	"github.com/gildasch/upspin-localserver/metrics"
 	"github.com/gildasch/upspin-localserver/packing"
 	"github.com/gildasch/upspin-localserver/store"
+	"github.com/gildasch/upspin-localserver/unixperm"
+	"github.com/pkg/errors"
 	"upspin.io/config"
 	"upspin.io/factotum"
 	_ "upspin.io/key/transports"
@@ -18,64 +32,564 @@ import (
 	"upspin.io/upspin"
 )
 
+const (
+	defaultUsername = "gildaschbt+local@gmail.com"
+	defaultSecrets  = "/home/gildas/.ssh/gildaschbt+local@gmail.com"
+)
+
+var logger = logging.For("main")
+
+// commands are the subcommands of the server, called with the arguments
+// following their name. Without a subcommand, the server is started.
+var commands = map[string]func(args []string){
+	"audit":  queryAudit,
+	"cat":    cat,
+	"check":  check,
+	"ls":     ls,
+	"rotate": rotate,
+	"setup":  setup,
+	"stat":   stat,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+
+	configPtr := flag.String("config", "",
+		"the upspin config file of the server user, as written by the setup subcommand")
 	rootPtr := flag.String("root", ".",
 		"the root directory to serve")
+	upperPtr := flag.String("upper", "",
+		"if set, a writable directory overlaid on top of the read-only root")
+	ignorePtr := flag.String("ignore", "",
+		"a file of gitignore-style rules hiding files of the whole tree")
+	hideDotfilesPtr := flag.Bool("hide-dotfiles", false,
+		"hide the files and directories starting with a dot")
+	keyPtr := flag.String("encryption-key", "",
+		"if set, a file holding the hex-encoded AES-256 key the files of the upper directory are encrypted with, the server refusing to start if one of them is not; the root is served as it is")
+	unixPermPtr := flag.Bool("unix-permissions", false,
+		"without an Access file, only let the owner access files not readable by everyone on the host")
+	cacheSizePtr := flag.Int("cache-size", 10000,
+		"the number of signed entries to keep in memory, 0 to disable the cache")
+	indexPtr := flag.Bool("index", false,
+		"serve the metadata of the tree from memory, kept current by watching the files")
+	snapshotPtr := flag.String("index-snapshot", "",
+		"if set, a file the index is saved to and restored from on startup")
+	indexCheckPtr := flag.Duration("index-check", 0,
+		"if set, the interval at which the index is compared with the files, 0 to disable")
+	listenPtr := flag.String("listen", "",
+		"where to listen: unix:<path>, systemd, tcp:<addr> or <addr> (default the socket passed by systemd if any, :$PORT otherwise)")
+	socketModePtr := flag.String("socket-mode", "0660",
+		"the octal file mode of the unix socket")
+	socketOwnerPtr := flag.String("socket-owner", "",
+		"if set, the user:group owning the unix socket")
+	certPtr := flag.String("tls-cert", "",
+		"if set, the PEM certificate to serve HTTPS with, reloaded on SIGHUP or when the file changes")
+	certKeyPtr := flag.String("tls-key", "",
+		"the PEM private key of the certificate")
+	selfSignedPtr := flag.String("tls-self-signed", "",
+		"if set, a directory to write a local CA and a certificate signed by it to, for testing")
+	tlsHostsPtr := flag.String("tls-hosts", "localhost",
+		"the comma-separated host names and addresses of the self-signed certificate")
+	drainPtr := flag.Duration("drain-timeout", 30*time.Second,
+		"on SIGINT or SIGTERM, how long to wait for the requests in flight before exiting")
+	auditPtr := flag.String("audit-log", "",
+		"if set, the file to record who accessed which path and block to")
+	auditSizePtr := flag.Int64("audit-max-size", 100,
+		"the size in MiB above which the audit log is rotated")
+	auditFilesPtr := flag.Int("audit-max-files", 10,
+		"the number of rotated audit logs to keep")
+	rateRequestsPtr := flag.Float64("rate-requests", 0,
+		"the number of block reads per second allowed to each user, 0 for no limit")
+	rateBytesPtr := flag.Float64("rate-bytes", 0,
+		"the number of bytes per second read for each user, 0 for no limit")
+	maxReadsPtr := flag.Int("max-reads", 0,
+		"the number of block reads running at once for all the users, 0 for no limit")
+	openFilesPtr := flag.Int("open-files", 64,
+		"the number of files kept open between block reads, 0 to open them on every read")
+	blockCachePtr := flag.Int64("block-cache", 64,
+		"the size in MiB of the blocks kept in memory, 0 to disable the block cache")
+	readAheadPtr := flag.Int("read-ahead", 4,
+		"the number of blocks read in advance when a file is read sequentially")
+	blockSizePtr, chunkSizePtr := packingFlags(flag.CommandLine)
+	logLevelPtr := flag.String("log-level", "info",
+		"the levels of the logs, as a default level followed by pkg=level pairs, e.g. info,dir=debug")
+	logFormatPtr := flag.String("log-format", "logfmt",
+		"the format of the logs: logfmt or json")
+	logAdminPtr := flag.Bool("log-admin", false,
+		"serve the log levels on /debug/log-levels, changed by PUT requests; only enable behind a proxy not forwarding that path")
 	debugPtr := flag.Bool("debug", false,
-		"activate debug mode")
+		"log everything at the debug level, same as -log-level debug")
 	flag.Parse()
 
+	if err := logging.Setup(os.Stderr, *logFormatPtr); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if err := logging.SetLevels(logLevels(*logLevelPtr, *debugPtr)); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
-	addr := upspin.NetAddr("http://localhost:" + port)
+	scheme := "http"
+	if *certPtr != "" || *selfSignedPtr != "" {
+		scheme = "https"
+	}
+	addr := upspin.NetAddr(scheme + "://localhost:" + port)
 
-	cfg := newConfig()
+	cfg, err := newConfig(*configPtr)
+	if err != nil {
+		logger.Error("could not load the config", "error", err)
+		os.Exit(1)
+	}
 
-	dirServer := dirserver.New(
-		cfg,
-		&dir.Dir{
-			Username: "gildaschbt+local@gmail.com",
-			Root:     *rootPtr,
-			Storage:  &local.Storage{*rootPtr},
-			Debug:    *debugPtr,
-			Factotum: cfg.Factotum(),
-			Packing:  packing.Plain{}},
-		addr)
+	storage, err := newStorage(*rootPtr, *upperPtr, *keyPtr, *ignorePtr, *hideDotfilesPtr)
+	if err != nil {
+		logger.Error("could not open the root", "error", err)
+		os.Exit(1)
+	}
+
+	simulator, chunks, err := newPacking(cfg, storage, *blockSizePtr, *chunkSizePtr)
+	if err != nil {
+		logger.Error("invalid packing", "error", err)
+		os.Exit(1)
+	}
+
+	var cache *packing.Cache
+	if *cacheSizePtr > 0 {
+		cache = packing.NewCache(simulator, *cacheSizePtr)
+	}
+
+	var blocks *store.BlockCache
+	if *blockCachePtr > 0 {
+		blocks = store.NewBlockCache(*blockCachePtr<<20, *readAheadPtr)
+	}
 
-	http.Handle("/api/Dir/", dirServer)
+	var closers []io.Closer
+	var index *local.Index
 
-	storeServer := storeserver.New(
-		cfg,
-		&store.Store{
-			Root:  *rootPtr,
-			Debug: *debugPtr},
-		addr)
+	if *indexPtr {
+		index = &local.Index{
+			Files: storage,
+			Roots: []string{*rootPtr},
+		}
+		if *upperPtr != "" {
+			index.Roots = append(index.Roots, *upperPtr)
+		}
+		index.OnChange = func(name string) {
+			if cache != nil {
+				cache.Invalidate(name)
+			}
+			if blocks != nil {
+				blocks.Invalidate(name)
+			}
+			if chunks != nil {
+				chunks.Invalidate(name)
+			}
+		}
+		if err := startIndex(index, *snapshotPtr, *indexCheckPtr); err != nil {
+			logger.Error("could not start the index", "error", err)
+			os.Exit(1)
+		}
+		storage = index
+		closers = append(closers, index)
+	}
 
-	http.Handle("/api/Store/", storeServer)
+	if cache != nil {
+		simulator = cache
+	}
 
-	fmt.Printf("Listening on %s...\n", port)
-	http.ListenAndServe(":"+port, nil)
+	d, s := newServers(cfg, storage, *rootPtr, simulator, *unixPermPtr)
+	if *openFilesPtr > 0 {
+		s.Handles = store.NewHandles(*openFilesPtr)
+		closers = append(closers, s.Handles)
+	}
+	s.Blocks = blocks
+	s.Chunks = chunks
+	if *auditPtr != "" {
+		auditLog := &audit.Log{
+			Name:     *auditPtr,
+			MaxSize:  *auditSizePtr << 20,
+			MaxFiles: *auditFilesPtr,
+		}
+		d.Audit, s.Audit = auditLog, auditLog
+		closers = append(closers, auditLog)
+	}
+
+	registry := &metrics.Registry{}
+	servers := metrics.NewServers(registry)
+
+	if chunks != nil {
+		registry.GaugeFunc("usl_chunks",
+			"Number of distinct chunks in the chunk index.", func() float64 {
+				_, n := chunks.Len()
+				return float64(n)
+			})
+	}
+	if blocks != nil {
+		registry.CounterFunc("usl_block_cache_hits_total",
+			"Number of blocks found in the block cache.", func() float64 {
+				hits, _, _ := blocks.Stats()
+				return float64(hits)
+			})
+		registry.CounterFunc("usl_block_cache_misses_total",
+			"Number of blocks not found in the block cache.", func() float64 {
+				_, misses, _ := blocks.Stats()
+				return float64(misses)
+			})
+		registry.CounterFunc("usl_block_cache_prefetched_total",
+			"Number of blocks read in advance.", func() float64 {
+				_, _, prefetched := blocks.Stats()
+				return float64(prefetched)
+			})
+		registry.GaugeFunc("usl_block_cache_bytes",
+			"Size of the blocks in the block cache.", func() float64 {
+				return float64(blocks.Bytes())
+			})
+	}
+
+	if *rateRequestsPtr > 0 || *rateBytesPtr > 0 || *maxReadsPtr > 0 {
+		throttled := registry.Counter("usl_throttled_total",
+			"Number of block reads refused by the rate limits, by limit.", "limit")
+		s.Limiter = &store.Limiter{
+			Requests:     *rateRequestsPtr,
+			RequestBurst: int(*rateRequestsPtr) + 1,
+			Bytes:        *rateBytesPtr,
+			ByteBurst:    int(*rateBytesPtr) + int(*blockSizePtr),
+			Concurrency:  *maxReadsPtr,
+			OnThrottle: func(user upspin.UserName, reason string) {
+				throttled.Inc(reason)
+			},
+		}
+	}
+	registry.GaugeFunc("usl_open_files",
+		"Number of file descriptors open by the server.", metrics.OpenFiles)
+	if cache != nil {
+		registry.CounterFunc("usl_signature_cache_hits_total",
+			"Number of signed entries found in the cache.", func() float64 {
+				hits, _ := cache.Stats()
+				return float64(hits)
+			})
+		registry.CounterFunc("usl_signature_cache_misses_total",
+			"Number of signed entries not found in the cache.", func() float64 {
+				_, misses := cache.Stats()
+				return float64(misses)
+			})
+	}
+
+	http.Handle("/api/Dir/", dirserver.New(cfg, servers.Dir(d), addr))
+	http.Handle("/api/Store/", storeserver.New(cfg, servers.Store(s), addr))
+	http.Handle("/metrics", registry)
+	http.HandleFunc("/healthz", health.Live)
+	http.Handle("/readyz", readiness(cfg, *rootPtr, index))
+	if *logAdminPtr {
+		http.Handle("/debug/log-levels", logging.Handler{})
+	}
+
+	socketMode, err := strconv.ParseUint(*socketModePtr, 8, 32)
+	if err != nil {
+		logger.Error("invalid socket mode", "mode", *socketModePtr, "error", err)
+		os.Exit(1)
+	}
+
+	ln, err := listen(*listenPtr, port, os.FileMode(socketMode), *socketOwnerPtr)
+	if err != nil {
+		logger.Error("could not listen", "error", err)
+		os.Exit(1)
+	}
+
+	if scheme == "https" {
+		reloader, err := newCertReloader(*certPtr, *certKeyPtr, *selfSignedPtr, *tlsHostsPtr)
+		if err != nil {
+			logger.Error("could not set up TLS", "error", err)
+			os.Exit(1)
+		}
+		closers = append(closers, reloader)
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := reloader.Reload(); err != nil {
+					logger.Warn("keeping the current certificate", "error", err)
+				}
+			}
+		}()
+
+		ln = tls.NewListener(ln, &tls.Config{GetCertificate: reloader.GetCertificate})
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	logger.Info("listening", "addr", ln.Addr())
+	if err := serve(&http.Server{}, ln, stop, *drainPtr, closers...); err != nil {
+		logger.Error("server stopped", "error", err)
+		os.Exit(1)
+	}
 }
 
-func newConfig() upspin.Config {
+// startIndex fills index from snapshot if it exists, and walks the
+// tree in the background to bring it up to date. If check is set, the
+// index is then compared with the files at that interval.
+func startIndex(index *local.Index, snapshot string, check time.Duration) error {
+	if snapshot != "" {
+		if err := index.Load(snapshot); err != nil && !os.IsNotExist(errors.Cause(err)) {
+			logger.Warn("ignoring index snapshot", "error", err)
+		}
+	}
+
+	if err := index.Watch(); err != nil {
+		return err
+	}
+
+	go func() {
+		if err := index.Build(); err != nil {
+			logger.Error("could not build index", "error", err)
+			return
+		}
+		for dir, err := range index.Unreadable() {
+			logger.Warn("directory left out of the index", "dir", dir, "error", err)
+		}
+		if snapshot != "" {
+			if err := index.Save(snapshot); err != nil {
+				logger.Error("could not save index snapshot", "error", err)
+			}
+		}
+
+		if check <= 0 {
+			return
+		}
+		for range time.Tick(check) {
+			diffs, err := index.Check()
+			if err != nil {
+				logger.Error("could not check index", "error", err)
+				continue
+			}
+			for _, diff := range diffs {
+				logger.Warn("index inconsistency", "diff", diff)
+			}
+			if len(diffs) > 0 {
+				if err := index.Build(); err != nil {
+					logger.Error("could not rebuild index", "error", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// readiness returns the checks that the root is readable, the factotum
+// signs and, if index is set, that it is built.
+func readiness(cfg upspin.Config, root string, index *local.Index) *health.Checks {
+	// The root directory is read from the disk, as the index would
+	// keep listing it from memory once unmounted.
+	storage := &local.Storage{Root: root}
+	checks := &health.Checks{Checks: []health.Check{{
+		Name: "root",
+		Func: func() error {
+			_, err := storage.List("/")
+			return err
+		},
+	}, {
+		Name: "factotum",
+		Func: func() error {
+			if cfg.Factotum() == nil {
+				return errors.New("no keys loaded")
+			}
+			fi := local.FileInfo{Filename: "/readyz", Dir: "/", Time: time.Now()}
+			_, err := packing.Plain{}.DirEntry(string(cfg.UserName()), fi, cfg.Factotum())
+			return err
+		},
+	}}}
+
+	if index != nil {
+		checks.Checks = append(checks.Checks, health.Check{
+			Name: "index",
+			Func: func() error {
+				if !index.Ready() {
+					return errors.New("not built yet")
+				}
+				return nil
+			},
+		})
+	}
+
+	return checks
+}
+
+// newCertReloader returns a certReloader serving the certificate of
+// cert and key or, if selfSignedDir is set, a certificate of hosts
+// signed by the local CA of selfSignedDir.
+func newCertReloader(cert, key, selfSignedDir, hosts string) (*certReloader, error) {
+	if selfSignedDir != "" {
+		var err error
+		cert, key, err = selfSigned(selfSignedDir, strings.Split(hosts, ","))
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("serving a self-signed certificate, clients must trust the CA",
+			"ca", filepath.Join(selfSignedDir, "ca.pem"))
+	}
+	if key == "" {
+		return nil, errors.New("-tls-key must be set along with -tls-cert")
+	}
+
+	reloader := &certReloader{CertFile: cert, KeyFile: key}
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+	if err := reloader.Watch(); err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+// logLevels returns the levels of spec, with the default level lowered
+// to debug if debug is set. Levels set for packages in spec are kept.
+func logLevels(spec string, debug bool) string {
+	if debug {
+		// The last default level of the spec wins.
+		return spec + ",debug"
+	}
+	return spec
+}
+
+// newServers returns the Dir and Store serving storage on behalf of the
+// user of cfg.
+func newServers(cfg upspin.Config, storage local.Files, root string, simulator packing.Simulator, unixPermissions bool) (*dir.Dir, *store.Store) {
+	username := string(cfg.UserName())
+
+	var dirPolicy dir.Policy
+	var storePolicy store.Policy
+	if unixPermissions {
+		policy := &unixperm.Policy{
+			Owner:   upspin.UserName(username),
+			Storage: storage,
+		}
+		dirPolicy, storePolicy = policy, policy
+	}
+
+	d := &dir.Dir{
+		Username: username,
+		Root:     root,
+		Storage:  storage,
+		Factotum: cfg.Factotum(),
+		Packing:  simulator,
+		Policy:   dirPolicy,
+		Logger:   logging.For("dir"),
+	}
+	s := &store.Store{
+		Username: username,
+		Root:     root,
+		Storage:  storage,
+		Policy:   storePolicy,
+		Logger:   logging.For("store"),
+	}
+
+	return d, s
+}
+
+// packingFlags defines the flags of the packing of the entries on fs.
+func packingFlags(fs *flag.FlagSet) (blockSize *int64, chunkSize *int) {
+	blockSize = fs.Int64("block-size", upspin.BlockSize,
+		"the size in bytes, up to 16 MiB, of the blocks the files are listed in; entries listed with an earlier size still resolve")
+	chunkSize = fs.Int("chunk-size", 0,
+		"if set, serve the files in chunks cut by their content, of this average size in bytes, so that clients reuse the chunks unchanged between versions of a file")
+	return blockSize, chunkSize
+}
+
+// newPacking returns the packing of the entries, in blocks of blockSize
+// bytes or, if chunkSize is not zero, in chunks of that average size cut
+// by their content, along with the index of those chunks.
+func newPacking(cfg upspin.Config, storage local.Files, blockSize int64, chunkSize int) (packing.Simulator, *packing.ChunkIndex, error) {
+	if blockSize <= 0 || blockSize > packing.MaxBlockSize {
+		return nil, nil, errors.Errorf("invalid -block-size %d: must be between 1 and %d", blockSize, packing.MaxBlockSize)
+	}
+	plain := packing.Plain{BlockSize: blockSize, Endpoint: cfg.StoreEndpoint()}
+	if chunkSize == 0 {
+		return plain, nil, nil
+	}
+
+	chunker := packing.NewChunker(chunkSize)
+	if err := chunker.Valid(); err != nil {
+		return nil, nil, errors.Wrapf(err, "invalid -chunk-size %d", chunkSize)
+	}
+	chunks := packing.NewChunkIndex(storage, chunker)
+
+	return packing.Chunked{Plain: plain, Index: chunks}, chunks, nil
+}
+
+func newStorage(root, upper, key, ignore string, hideDotfiles bool) (local.Files, error) {
+	var files local.Files = &local.Storage{Root: root}
+	if upper != "" {
+		overlay := &local.Overlay{
+			Upper: &local.Storage{Root: upper},
+			Lower: []*local.Storage{{Root: root}},
+		}
+		if key != "" {
+			k, err := local.ReadKeyFile(key)
+			if err != nil {
+				return nil, err
+			}
+			overlay.Key = k
+			if err := overlay.CheckEncrypted(); err != nil {
+				return nil, errors.Wrap(err, "-encryption-key needs the files of the upper directory to be encrypted")
+			}
+		}
+		files = overlay
+	} else if key != "" {
+		return nil, errors.New("-encryption-key needs -upper: only the files of the upper directory are encrypted")
+	}
+
+	var global []string
+	if ignore != "" {
+		var err error
+		global, err = local.ReadIgnoreFile(ignore)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &local.Filter{
+		Files:        files,
+		Global:       global,
+		HideDotfiles: hideDotfiles,
+	}, nil
+}
+
+func newConfig(file string) (upspin.Config, error) {
+	if file != "" {
+		return config.FromFile(file)
+	}
+
 	endpoint := upspin.Endpoint{
 		Transport: upspin.Remote,
 		NetAddr:   "usl.gildas.ch",
 	}
 	cfg := config.New()
-	cfg = config.SetUserName(cfg, upspin.UserName("gildaschbt+local@gmail.com"))
+	cfg = config.SetUserName(cfg, upspin.UserName(defaultUsername))
 	cfg = config.SetPacking(cfg, upspin.PlainPack)
 	cfg = config.SetStoreEndpoint(cfg, endpoint)
 	cfg = config.SetDirEndpoint(cfg, endpoint)
 
-	f, err := factotum.NewFromDir(
-		"/home/gildas/.ssh/gildaschbt+local@gmail.com")
+	// The previous keys of the user, if any, are loaded from the
+	// secret2.upspinkey file and used to sign entries during rotations.
+	f, err := factotum.NewFromDir(defaultSecrets)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	cfg = config.SetFactotum(cfg, f)
 
-	return cfg
+	return cfg, nil
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/gildasch/upspin-localserver/local"
+	"github.com/gildasch/upspin-localserver/logging"
+	"github.com/gildasch/upspin-localserver/packing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"upspin.io/config"
+)
+
+func TestDebugLowersTheLevel(t *testing.T) {
+	defer logging.SetLevels("info")
+
+	logger := logging.For("debugtest")
+
+	require.NoError(t, logging.SetLevels(logLevels("info", false)))
+	assert.False(t, logger.Enabled(context.Background(), slog.LevelDebug))
+
+	require.NoError(t, logging.SetLevels(logLevels("info", true)))
+	assert.True(t, logger.Enabled(context.Background(), slog.LevelDebug))
+
+	require.NoError(t, logging.SetLevels(logLevels("warn,debugtest=error", true)))
+	assert.Equal(t, "debug,debugtest=error", logging.Levels())
+}
+
+func TestNewPacking(t *testing.T) {
+	cfg := config.New()
+	storage := &local.Storage{Root: t.TempDir()}
+
+	simulator, chunks, err := newPacking(cfg, storage, 4096, 0)
+	require.NoError(t, err)
+	assert.Equal(t, packing.Plain{BlockSize: 4096, Endpoint: cfg.StoreEndpoint()}, simulator)
+	assert.Nil(t, chunks)
+
+	simulator, chunks, err = newPacking(cfg, storage, 4096, 16<<10)
+	require.NoError(t, err)
+	require.NotNil(t, chunks)
+	assert.Equal(t, packing.Chunked{Plain: packing.Plain{BlockSize: 4096, Endpoint: cfg.StoreEndpoint()}, Index: chunks}, simulator)
+
+	_, _, err = newPacking(cfg, storage, 0, 0)
+	assert.Error(t, err)
+	_, _, err = newPacking(cfg, storage, packing.MaxBlockSize+1, 0)
+	assert.Error(t, err)
+	_, _, err = newPacking(cfg, storage, 4096, -1)
+	assert.Error(t, err)
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	r := &Registry{}
+
+	c := r.Counter("requests_total", "Number of requests.", "method")
+	c.Inc("Get")
+	c.Add(2, "Get")
+	c.Inc(`Odd "method"`)
+
+	h := r.Histogram("duration_seconds", "Latency.", []float64{0.1, 1}, "method")
+	h.Observe(0.05, "Get")
+	h.Observe(0.5, "Get")
+	h.Observe(5, "Get")
+
+	r.GaugeFunc("open_files", "Open files.", func() float64 { return 12 })
+
+	var buf bytes.Buffer
+	r.Write(&buf)
+
+	assert.Equal(t, `# HELP duration_seconds Latency.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{method="Get",le="0.1"} 1
+duration_seconds_bucket{method="Get",le="1"} 2
+duration_seconds_bucket{method="Get",le="+Inf"} 3
+duration_seconds_sum{method="Get"} 5.55
+duration_seconds_count{method="Get"} 3
+# HELP open_files Open files.
+# TYPE open_files gauge
+open_files 12
+# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{method="Get"} 3
+requests_total{method="Odd \"method\""} 1
+`, buf.String())
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	r := &Registry{}
+	r.Counter("bytes_total", "Bytes.").Add(1024)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "\nbytes_total 1024\n")
+}
+
+func TestRegistryPanicsOnMisuse(t *testing.T) {
+	r := &Registry{}
+	c := r.Counter("requests_total", "Number of requests.", "method")
+
+	assert.Panics(t, func() { r.Counter("requests_total", "Again.") })
+	assert.Panics(t, func() { c.Inc() })
+}
@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"time"
+
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// Servers counts the calls to the methods of the dir and store servers
+// it wraps, their errors by kind, their latency and the bytes served.
+type Servers struct {
+	requests *Counter
+	failures *Counter
+	duration *Histogram
+	bytes    *Counter
+}
+
+// NewServers registers the metrics of the servers in r.
+func NewServers(r *Registry) *Servers {
+	return &Servers{
+		requests: r.Counter("usl_requests_total",
+			"Number of calls to the dir and store servers.", "method"),
+		failures: r.Counter("usl_errors_total",
+			"Number of calls to the dir and store servers that failed, by upspin error kind.", "method", "kind"),
+		duration: r.Histogram("usl_request_duration_seconds",
+			"Latency of the calls to the dir and store servers.", DefaultBuckets, "method"),
+		bytes: r.Counter("usl_store_bytes_served_total",
+			"Number of bytes of blocks returned by Store.Get."),
+	}
+}
+
+// Dir returns d reporting its calls to s.
+func (s *Servers) Dir(d upspin.DirServer) upspin.DirServer {
+	return &dirServer{DirServer: d, metrics: s}
+}
+
+// Store returns st reporting its calls to s.
+func (s *Servers) Store(st upspin.StoreServer) upspin.StoreServer {
+	return &storeServer{StoreServer: st, metrics: s}
+}
+
+// observe records a call to method started at start that returned err.
+func (s *Servers) observe(method string, start time.Time, err error) {
+	s.requests.Inc(method)
+	s.duration.Observe(time.Since(start).Seconds(), method)
+
+	if err != nil && err != upspin.ErrFollowLink {
+		kind := errors.Other.String()
+		if e, ok := err.(*errors.Error); ok {
+			kind = e.Kind.String()
+		}
+		s.failures.Inc(method, kind)
+	}
+}
+
+type dirServer struct {
+	upspin.DirServer
+	metrics *Servers
+}
+
+func (d *dirServer) Dial(config upspin.Config, endpoint upspin.Endpoint) (upspin.Service, error) {
+	start := time.Now()
+	service, err := d.DirServer.Dial(config, endpoint)
+	d.metrics.observe("Dir.Dial", start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dirServer{DirServer: service.(upspin.DirServer), metrics: d.metrics}, nil
+}
+
+func (d *dirServer) Lookup(name upspin.PathName) (*upspin.DirEntry, error) {
+	start := time.Now()
+	de, err := d.DirServer.Lookup(name)
+	d.metrics.observe("Dir.Lookup", start, err)
+	return de, err
+}
+
+func (d *dirServer) Glob(pattern string) ([]*upspin.DirEntry, error) {
+	start := time.Now()
+	entries, err := d.DirServer.Glob(pattern)
+	d.metrics.observe("Dir.Glob", start, err)
+	return entries, err
+}
+
+type storeServer struct {
+	upspin.StoreServer
+	metrics *Servers
+}
+
+func (s *storeServer) Dial(config upspin.Config, endpoint upspin.Endpoint) (upspin.Service, error) {
+	start := time.Now()
+	service, err := s.StoreServer.Dial(config, endpoint)
+	s.metrics.observe("Store.Dial", start, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &storeServer{StoreServer: service.(upspin.StoreServer), metrics: s.metrics}, nil
+}
+
+func (s *storeServer) Get(ref upspin.Reference) ([]byte, *upspin.Refdata, []upspin.Location, error) {
+	start := time.Now()
+	data, refdata, locations, err := s.StoreServer.Get(ref)
+	s.metrics.observe("Store.Get", start, err)
+	s.metrics.bytes.Add(float64(len(data)))
+	return data, refdata, locations, err
+}
+
+// OpenFiles returns the number of file descriptors open by the process,
+// or -1 if it is not known on this system.
+func OpenFiles() float64 {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return float64(len(fds))
+}
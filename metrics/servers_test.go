@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+type fakeDir struct {
+	upspin.DirServer
+}
+
+func (d *fakeDir) Dial(upspin.Config, upspin.Endpoint) (upspin.Service, error) {
+	return d, nil
+}
+
+func (d *fakeDir) Lookup(name upspin.PathName) (*upspin.DirEntry, error) {
+	if name == "user@example.com/missing" {
+		return nil, errors.E(name, errors.NotExist)
+	}
+	return &upspin.DirEntry{Name: name}, nil
+}
+
+type fakeStore struct {
+	upspin.StoreServer
+}
+
+func (s *fakeStore) Get(ref upspin.Reference) ([]byte, *upspin.Refdata, []upspin.Location, error) {
+	return []byte("hello"), &upspin.Refdata{Reference: ref}, nil, nil
+}
+
+func TestServers(t *testing.T) {
+	s := NewServers(&Registry{})
+
+	dir := s.Dir(&fakeDir{})
+	service, err := dir.Dial(nil, upspin.Endpoint{})
+	require.NoError(t, err)
+	dialed := service.(upspin.DirServer)
+
+	_, err = dialed.Lookup("user@example.com/file")
+	assert.NoError(t, err)
+	_, err = dialed.Lookup("user@example.com/missing")
+	assert.Error(t, err)
+
+	store := s.Store(&fakeStore{})
+	data, _, _, err := store.Get("file-0")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	assert.Equal(t, float64(1), s.requests.Value("Dir.Dial"))
+	assert.Equal(t, float64(2), s.requests.Value("Dir.Lookup"))
+	assert.Equal(t, float64(1), s.requests.Value("Store.Get"))
+	assert.Equal(t, float64(1), s.failures.Value("Dir.Lookup", errors.NotExist.String()))
+	assert.Equal(t, float64(5), s.bytes.Value())
+}
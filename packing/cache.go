@@ -0,0 +1,155 @@
+package packing
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/gildasch/upspin-localserver/local"
+	"upspin.io/upspin"
+)
+
+// Cache is a Simulator remembering the last entries signed by
+// Simulator, so that the files not modified since their last lookup are
+// not signed again. Entries are keyed by path, size, modification time
+// and packing: any change to the file makes its cached entry stale.
+type Cache struct {
+	Simulator Simulator
+
+	mu      sync.Mutex
+	size    int
+	lru     *list.List
+	entries map[cacheKey]*list.Element
+	hits    uint64
+	misses  uint64
+}
+
+type cacheKey struct {
+	username string
+	filename string
+	size     int64
+	time     int64
+	packing  upspin.Packing
+}
+
+type cacheItem struct {
+	key   cacheKey
+	entry *upspin.DirEntry
+}
+
+// NewCache returns a Cache of Simulator holding at most size entries.
+func NewCache(simulator Simulator, size int) *Cache {
+	return &Cache{
+		Simulator: simulator,
+		size:      size,
+		lru:       list.New(),
+		entries:   map[cacheKey]*list.Element{},
+	}
+}
+
+func (c *Cache) DirEntry(username string, fi local.FileInfo, factotum Factotum) (*upspin.DirEntry, error) {
+	key := cacheKey{
+		username: username,
+		filename: fi.Filename,
+		size:     fi.Size,
+		time:     fi.Time.UnixNano(),
+		packing:  packingOf(c.Simulator),
+	}
+
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		c.hits++
+		de := copyDirEntry(e.Value.(*cacheItem).entry)
+		c.mu.Unlock()
+		return de, nil
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	de, err := c.Simulator.DirEntry(username, fi, factotum)
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := c.Simulator.(interface {
+		provisional(de *upspin.DirEntry) bool
+	}); ok && p.provisional(de) {
+		return de, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok {
+		c.entries[key] = c.lru.PushFront(&cacheItem{key: key, entry: copyDirEntry(de)})
+		for c.lru.Len() > c.size {
+			c.remove(c.lru.Back())
+		}
+	}
+
+	return de, nil
+}
+
+// Invalidate drops the cached entries of the file filename.
+func (c *Cache) Invalidate(filename string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, e := range c.entries {
+		if key.filename == filename {
+			c.remove(e)
+		}
+	}
+}
+
+// Stats returns the number of lookups served from the cache and the
+// number of entries that had to be signed.
+func (c *Cache) Stats() (hits, misses uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.hits, c.misses
+}
+
+// Len returns the number of entries held by the cache.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+func (c *Cache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*cacheItem).key)
+}
+
+// packingOf returns the packing of the entries produced by s, if it
+// tells.
+func packingOf(s Simulator) upspin.Packing {
+	if p, ok := s.(interface {
+		Packing() upspin.Packing
+	}); ok {
+		return p.Packing()
+	}
+	return upspin.PlainPack
+}
+
+// copyDirEntry returns a copy of de that can be modified without
+// altering the cached one.
+func copyDirEntry(de *upspin.DirEntry) *upspin.DirEntry {
+	if de == nil {
+		return nil
+	}
+
+	cp := *de
+	cp.Packdata = append([]byte(nil), de.Packdata...)
+	if de.Blocks != nil {
+		cp.Blocks = make([]upspin.DirBlock, len(de.Blocks))
+		for i, b := range de.Blocks {
+			b.Packdata = append([]byte(nil), b.Packdata...)
+			cp.Blocks[i] = b
+		}
+	}
+
+	return &cp
+}
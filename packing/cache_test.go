@@ -0,0 +1,127 @@
+package packing
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gildasch/upspin-localserver/local"
+	"github.com/stretchr/testify/assert"
+	"upspin.io/upspin"
+)
+
+type countingSimulator struct {
+	calls int
+}
+
+func (cs *countingSimulator) DirEntry(username string, fi local.FileInfo, factotum Factotum) (*upspin.DirEntry, error) {
+	cs.calls++
+	if fi.Filename == "/unsignable" {
+		return nil, errors.New("could not sign")
+	}
+	return &upspin.DirEntry{
+		Name:     upspin.PathName(username + fi.Filename),
+		Packdata: []byte{byte(cs.calls)},
+	}, nil
+}
+
+func TestCacheHitsUnmodifiedFiles(t *testing.T) {
+	simulator := &countingSimulator{}
+	cache := NewCache(simulator, 10)
+
+	fi := local.FileInfo{
+		Filename: "/albert.txt",
+		Size:     20,
+		Time:     time.Unix(1500000000, 0),
+	}
+
+	first, err := cache.DirEntry("test.user@some-mail.com", fi, nil)
+	assert.NoError(t, err)
+	second, err := cache.DirEntry("test.user@some-mail.com", fi, nil)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, simulator.calls)
+	assert.Equal(t, first, second)
+	hits, misses := cache.Stats()
+	assert.Equal(t, uint64(1), hits)
+	assert.Equal(t, uint64(1), misses)
+
+	second.Packdata[0] = 42
+	third, _ := cache.DirEntry("test.user@some-mail.com", fi, nil)
+	assert.Equal(t, []byte{1}, third.Packdata)
+}
+
+func TestCacheMissesModifiedFiles(t *testing.T) {
+	simulator := &countingSimulator{}
+	cache := NewCache(simulator, 10)
+
+	fi := local.FileInfo{
+		Filename: "/albert.txt",
+		Size:     20,
+		Time:     time.Unix(1500000000, 0),
+	}
+	cache.DirEntry("test.user@some-mail.com", fi, nil)
+
+	fi.Time = fi.Time.Add(time.Second)
+	cache.DirEntry("test.user@some-mail.com", fi, nil)
+
+	fi.Size = 21
+	cache.DirEntry("test.user@some-mail.com", fi, nil)
+
+	cache.DirEntry("other.user@some-mail.com", fi, nil)
+
+	assert.Equal(t, 4, simulator.calls)
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	simulator := &countingSimulator{}
+	cache := NewCache(simulator, 2)
+
+	a := local.FileInfo{Filename: "/a"}
+	b := local.FileInfo{Filename: "/b"}
+	c := local.FileInfo{Filename: "/c"}
+
+	cache.DirEntry("test.user@some-mail.com", a, nil)
+	cache.DirEntry("test.user@some-mail.com", b, nil)
+	cache.DirEntry("test.user@some-mail.com", a, nil)
+	cache.DirEntry("test.user@some-mail.com", c, nil)
+	assert.Equal(t, 2, cache.Len())
+	assert.Equal(t, 3, simulator.calls)
+
+	cache.DirEntry("test.user@some-mail.com", a, nil)
+	assert.Equal(t, 3, simulator.calls)
+	cache.DirEntry("test.user@some-mail.com", b, nil)
+	assert.Equal(t, 4, simulator.calls)
+}
+
+func TestCacheDoesNotKeepErrors(t *testing.T) {
+	simulator := &countingSimulator{}
+	cache := NewCache(simulator, 10)
+
+	fi := local.FileInfo{Filename: "/unsignable"}
+
+	_, err := cache.DirEntry("test.user@some-mail.com", fi, nil)
+	assert.Error(t, err)
+	_, err = cache.DirEntry("test.user@some-mail.com", fi, nil)
+	assert.Error(t, err)
+
+	assert.Equal(t, 2, simulator.calls)
+	assert.Equal(t, 0, cache.Len())
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	simulator := &countingSimulator{}
+	cache := NewCache(simulator, 10)
+
+	a := local.FileInfo{Filename: "/a"}
+	b := local.FileInfo{Filename: "/b"}
+
+	cache.DirEntry("test.user@some-mail.com", a, nil)
+	cache.DirEntry("test.user@some-mail.com", b, nil)
+	cache.Invalidate("/a")
+	assert.Equal(t, 1, cache.Len())
+
+	cache.DirEntry("test.user@some-mail.com", a, nil)
+	cache.DirEntry("test.user@some-mail.com", b, nil)
+	assert.Equal(t, 3, simulator.calls)
+}
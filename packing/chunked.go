@@ -0,0 +1,290 @@
+package packing
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"github.com/gildasch/upspin-localserver/local"
+	"upspin.io/upspin"
+)
+
+// chunkRefPrefix starts the references of the chunks. They hold no "-",
+// which tells them apart from the references of fixed-size blocks.
+const chunkRefPrefix = "sha256:"
+
+// ChunkRef returns the reference of the chunk of content hash sum. It
+// only depends on the content of the chunk, so that the chunks shared by
+// several files, or several versions of a file, are fetched and cached
+// once by the clients.
+func ChunkRef(sum [sha256.Size]byte) upspin.Reference {
+	return upspin.Reference(chunkRefPrefix + hex.EncodeToString(sum[:]))
+}
+
+// ParseChunkRef returns the content hash of the chunk referenced by ref,
+// or false if ref is not the reference of a chunk.
+func ParseChunkRef(ref upspin.Reference) (sum [sha256.Size]byte, ok bool) {
+	s := string(ref)
+	if !strings.HasPrefix(s, chunkRefPrefix) {
+		return sum, false
+	}
+	b, err := hex.DecodeString(s[len(chunkRefPrefix):])
+	if err != nil || len(b) != sha256.Size {
+		return sum, false
+	}
+	copy(sum[:], b)
+	return sum, true
+}
+
+// BlockLocation is where the content of a block is found.
+type BlockLocation struct {
+	Filename string
+	Offset   int64
+	Size     int64
+}
+
+// Opener opens the files to chunk.
+type Opener interface {
+	Open(name string) (local.File, error)
+}
+
+// ChunkIndex remembers the chunks of the files cut by its Chunker, to
+// find where the content of a chunk is when it is requested. Files are
+// chunked again when their size or modification time changes.
+//
+// The index is only held in memory: a chunk can only be read once the
+// entry of a file holding it has been looked up since the server started.
+type ChunkIndex struct {
+	Files   Opener
+	Chunker Chunker
+
+	// Workers is the number of files chunked at once in the background,
+	// 1 if zero.
+	Workers int
+
+	mu      sync.Mutex
+	files   map[string]chunkedFile
+	chunks  map[[sha256.Size]byte][]BlockLocation
+	pending map[string]chan struct{}
+	running int
+}
+
+type chunkedFile struct {
+	size   int64
+	time   int64
+	chunks []Chunk
+}
+
+// NewChunkIndex returns a ChunkIndex of the files opened with files and
+// cut by chunker.
+func NewChunkIndex(files Opener, chunker Chunker) *ChunkIndex {
+	return &ChunkIndex{
+		Files:   files,
+		Chunker: chunker,
+		files:   map[string]chunkedFile{},
+		chunks:  map[[sha256.Size]byte][]BlockLocation{},
+		pending: map[string]chan struct{}{},
+	}
+}
+
+// Lookup returns the chunks of the file fi if it was chunked since it was
+// last modified. Otherwise it returns false and, unless Workers files are
+// being chunked already, chunks it in the background.
+func (x *ChunkIndex) Lookup(fi local.FileInfo) ([]Chunk, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if chunks, ok := x.currentLocked(fi); ok {
+		return chunks, true
+	}
+
+	workers := x.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	if _, ok := x.pending[fi.Filename]; ok || x.running >= workers {
+		return nil, false
+	}
+
+	x.running++
+	done := x.startLocked(fi.Filename)
+	go func() {
+		x.chunk(fi, done)
+		x.mu.Lock()
+		x.running--
+		x.mu.Unlock()
+	}()
+
+	return nil, false
+}
+
+// Chunk returns the chunks of the file fi, chunking it if it was not yet
+// or was modified since. A file is only chunked by one call at once, the
+// others wait for it.
+func (x *ChunkIndex) Chunk(fi local.FileInfo) ([]Chunk, error) {
+	for {
+		x.mu.Lock()
+		if chunks, ok := x.currentLocked(fi); ok {
+			x.mu.Unlock()
+			return chunks, nil
+		}
+		wait, ok := x.pending[fi.Filename]
+		if !ok {
+			done := x.startLocked(fi.Filename)
+			x.mu.Unlock()
+			return x.chunk(fi, done)
+		}
+		x.mu.Unlock()
+		<-wait
+	}
+}
+
+// currentLocked returns the chunks of fi, if they are those of its
+// current version.
+func (x *ChunkIndex) currentLocked(fi local.FileInfo) ([]Chunk, bool) {
+	f, ok := x.files[fi.Filename]
+	if !ok || f.size != fi.Size || f.time != fi.Time.UnixNano() {
+		return nil, false
+	}
+	return f.chunks, true
+}
+
+// startLocked records that the file filename is being chunked, and
+// returns the channel to close once done.
+func (x *ChunkIndex) startLocked(filename string) chan struct{} {
+	done := make(chan struct{})
+	x.pending[filename] = done
+	return done
+}
+
+// chunk chunks the file fi and adds its chunks to the index, then closes
+// done.
+func (x *ChunkIndex) chunk(fi local.FileInfo, done chan struct{}) ([]Chunk, error) {
+	defer func() {
+		x.mu.Lock()
+		delete(x.pending, fi.Filename)
+		x.mu.Unlock()
+		close(done)
+	}()
+
+	r, err := x.Files.Open(fi.Filename)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	version := chunkedFile{size: fi.Size, time: fi.Time.UnixNano()}
+	version.chunks, err = x.Chunker.Split(r)
+	if err != nil {
+		return nil, err
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.removeLocked(fi.Filename)
+	x.files[fi.Filename] = version
+	for _, c := range version.chunks {
+		x.chunks[c.Sum] = append(x.chunks[c.Sum], BlockLocation{
+			Filename: fi.Filename,
+			Offset:   c.Offset,
+			Size:     c.Size,
+		})
+	}
+
+	return version.chunks, nil
+}
+
+// Locate returns the places where the chunk of content hash sum was
+// found. A nil ChunkIndex knows no chunks.
+func (x *ChunkIndex) Locate(sum [sha256.Size]byte) []BlockLocation {
+	if x == nil {
+		return nil
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	return append([]BlockLocation(nil), x.chunks[sum]...)
+}
+
+// Invalidate forgets the chunks of the file filename.
+func (x *ChunkIndex) Invalidate(filename string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.removeLocked(filename)
+}
+
+// Len returns the number of files chunked and of distinct chunks.
+func (x *ChunkIndex) Len() (files, chunks int) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	return len(x.files), len(x.chunks)
+}
+
+func (x *ChunkIndex) removeLocked(filename string) {
+	f, ok := x.files[filename]
+	if !ok {
+		return
+	}
+	delete(x.files, filename)
+
+	for _, c := range f.chunks {
+		locations := x.chunks[c.Sum][:0]
+		for _, l := range x.chunks[c.Sum] {
+			if l.Filename != filename {
+				locations = append(locations, l)
+			}
+		}
+		if len(locations) == 0 {
+			delete(x.chunks, c.Sum)
+		} else {
+			x.chunks[c.Sum] = locations
+		}
+	}
+}
+
+// Chunked is a Simulator packing the files like Plain, in chunks cut by
+// the Chunker of Index rather than in fixed-size blocks. Files are chunked
+// in the background: until they are, their entries hold the fixed-size
+// blocks of Plain.
+type Chunked struct {
+	Plain
+	Index *ChunkIndex
+}
+
+func (c Chunked) DirEntry(username string, fi local.FileInfo, factotum Factotum) (*upspin.DirEntry, error) {
+	e, err := c.Plain.DirEntry(username, fi, factotum)
+	if err != nil || fi.IsDir {
+		return e, err
+	}
+
+	// The signature of plain entries does not cover the blocks, they can
+	// be replaced once signed.
+	if chunks, ok := c.Index.Lookup(fi); ok {
+		e.Blocks = blocksFromChunks(chunks, c.endpoint())
+	}
+
+	return e, nil
+}
+
+// provisional reports whether de is an entry of fixed-size blocks of a
+// file not chunked yet, which should not be cached.
+func (c Chunked) provisional(de *upspin.DirEntry) bool {
+	if len(de.Blocks) == 0 {
+		return false
+	}
+	_, ok := ParseChunkRef(de.Blocks[0].Location.Reference)
+	return !ok
+}
+
+func blocksFromChunks(chunks []Chunk, endpoint upspin.Endpoint) (dbs []upspin.DirBlock) {
+	for _, c := range chunks {
+		dbs = append(dbs, dirBlock(endpoint, ChunkRef(c.Sum), c.Offset, c.Size))
+	}
+
+	return
+}
@@ -0,0 +1,306 @@
+package packing
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"math/big"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gildasch/upspin-localserver/local"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"upspin.io/pack"
+	"upspin.io/upspin"
+)
+
+func randomData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestChunkerSplit(t *testing.T) {
+	c := NewChunker(8 << 10)
+	data := randomData(1, 1<<20)
+
+	chunks, err := c.Split(bytes.NewReader(data))
+	require.NoError(t, err)
+
+	offset := int64(0)
+	for i, chunk := range chunks {
+		assert.Equal(t, offset, chunk.Offset)
+		if i < len(chunks)-1 {
+			assert.True(t, chunk.Size >= int64(c.Min), "chunk %d of %d bytes", i, chunk.Size)
+		}
+		assert.True(t, chunk.Size <= int64(c.Max), "chunk %d of %d bytes", i, chunk.Size)
+		assert.Equal(t, sha256.Sum256(data[chunk.Offset:chunk.Offset+chunk.Size]), chunk.Sum)
+		offset += chunk.Size
+	}
+	assert.Equal(t, int64(len(data)), offset)
+
+	// The chunks are around the average size.
+	assert.InDelta(t, 128, len(chunks), 64)
+
+	again, err := c.Split(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, chunks, again)
+
+	chunks, err = c.Split(bytes.NewReader(nil))
+	require.NoError(t, err)
+	assert.Empty(t, chunks)
+}
+
+func TestChunkerKeepsChunksAroundInsertions(t *testing.T) {
+	c := NewChunker(8 << 10)
+	data := randomData(2, 1<<20)
+	modified := append([]byte("inserted"), data...)
+	modified = append(modified[:500000:500000], append([]byte("again"), modified[500000:]...)...)
+
+	before, err := c.Split(bytes.NewReader(data))
+	require.NoError(t, err)
+	after, err := c.Split(bytes.NewReader(modified))
+	require.NoError(t, err)
+
+	sums := map[[sha256.Size]byte]bool{}
+	for _, chunk := range before {
+		sums[chunk.Sum] = true
+	}
+	changed := 0
+	for _, chunk := range after {
+		if !sums[chunk.Sum] {
+			changed++
+		}
+	}
+	assert.True(t, changed <= 4, "%d chunks of %d changed", changed, len(after))
+}
+
+func TestChunkerValid(t *testing.T) {
+	assert.NoError(t, NewChunker(1<<20).Valid())
+	assert.Error(t, NewChunker(0).Valid())
+	assert.Error(t, NewChunker(3).Valid())
+	assert.Error(t, NewChunker(MaxBlockSize+1).Valid())
+	assert.Error(t, Chunker{Min: 10, Avg: 5, Max: 20}.Valid())
+}
+
+func TestChunkRef(t *testing.T) {
+	sum := sha256.Sum256([]byte("chunk"))
+	ref := ChunkRef(sum)
+
+	parsed, ok := ParseChunkRef(ref)
+	assert.True(t, ok)
+	assert.Equal(t, sum, parsed)
+
+	_, _, _, err := ParseRef(ref)
+	assert.Error(t, err, "chunk references are not block references")
+
+	for _, ref := range []upspin.Reference{"/a.txt-0", "sha256:", "sha256:zz", "sha256:abcd"} {
+		_, ok := ParseChunkRef(ref)
+		assert.False(t, ok, ref)
+	}
+}
+
+func TestChunkIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packing")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data := randomData(3, 100<<10)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a"), data, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "b"), data, 0644))
+
+	storage := &local.Storage{Root: dir}
+	x := NewChunkIndex(storage, NewChunker(8<<10))
+
+	fia, err := storage.Stat("a")
+	require.NoError(t, err)
+	fib, err := storage.Stat("b")
+	require.NoError(t, err)
+
+	chunks, err := x.Chunk(fia)
+	require.NoError(t, err)
+	require.NotEmpty(t, chunks)
+	_, err = x.Chunk(fib)
+	require.NoError(t, err)
+
+	files, n := x.Len()
+	assert.Equal(t, 2, files)
+	assert.Equal(t, len(chunks), n, "the chunks of the same content are shared")
+
+	first := chunks[0]
+	assert.ElementsMatch(t, []BlockLocation{
+		{Filename: fia.Filename, Offset: 0, Size: first.Size},
+		{Filename: fib.Filename, Offset: 0, Size: first.Size},
+	}, x.Locate(first.Sum))
+
+	// A modified file is chunked again.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "b"), []byte("other"), 0644))
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "b"), later, later))
+	fib, err = storage.Stat("b")
+	require.NoError(t, err)
+	_, err = x.Chunk(fib)
+	require.NoError(t, err)
+
+	assert.Equal(t, []BlockLocation{{Filename: fia.Filename, Offset: 0, Size: first.Size}}, x.Locate(first.Sum))
+	assert.Len(t, x.Locate(sha256.Sum256([]byte("other"))), 1)
+
+	x.Invalidate(fia.Filename)
+	assert.Empty(t, x.Locate(first.Sum))
+	files, n = x.Len()
+	assert.Equal(t, 1, files)
+	assert.Equal(t, 1, n)
+
+	assert.Empty(t, (*ChunkIndex)(nil).Locate(first.Sum))
+}
+
+func Test_ChunkedPackRecognizedByUnpack(t *testing.T) {
+	cfg, _, _, _ := newConfigAndServices(upspin.UserName("test.user@some-mail.com"))
+
+	storage := &local.Storage{Root: "."}
+	fi, err := storage.Stat("albert.txt")
+	require.NoError(t, err)
+
+	chunked := Chunked{Index: NewChunkIndex(storage, NewChunker(8))}
+	_, err = chunked.Index.Chunk(fi)
+	require.NoError(t, err)
+	d, err := chunked.DirEntry("test.user@some-mail.com", fi, cfg.Factotum())
+	require.NoError(t, err)
+
+	require.NotEmpty(t, d.Blocks)
+	size := int64(0)
+	for _, b := range d.Blocks {
+		_, ok := ParseChunkRef(b.Location.Reference)
+		assert.True(t, ok)
+		assert.Equal(t, size, b.Offset)
+		size += b.Size
+	}
+	assert.Equal(t, fi.Size, size)
+
+	_, err = pack.Lookup(upspin.PlainPack).Unpack(cfg, d)
+	assert.NoError(t, err)
+}
+
+// countingOpener counts the files opened.
+type countingOpener struct {
+	Opener
+
+	mu     sync.Mutex
+	opened int
+}
+
+func (c *countingOpener) Open(name string) (local.File, error) {
+	c.mu.Lock()
+	c.opened++
+	c.mu.Unlock()
+	return c.Opener.Open(name)
+}
+
+func newChunkedFile(t *testing.T) (storage *local.Storage, fi local.FileInfo, cleanup func()) {
+	dir, err := ioutil.TempDir("", "packing")
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), randomData(4, 100<<10), 0644))
+	storage = &local.Storage{Root: dir}
+	fi, err = storage.Stat("file")
+	require.NoError(t, err)
+
+	return storage, fi, func() { os.RemoveAll(dir) }
+}
+
+func TestChunkIndexChunksOnce(t *testing.T) {
+	storage, fi, cleanup := newChunkedFile(t)
+	defer cleanup()
+
+	opener := &countingOpener{Opener: storage}
+	x := NewChunkIndex(opener, NewChunker(8<<10))
+
+	var wg sync.WaitGroup
+	results := make([][]Chunk, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			chunks, err := x.Chunk(fi)
+			assert.NoError(t, err)
+			results[i] = chunks
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, opener.opened)
+	for _, chunks := range results {
+		assert.Equal(t, results[0], chunks)
+	}
+}
+
+func TestChunkIndexLookupChunksInBackground(t *testing.T) {
+	storage, fi, cleanup := newChunkedFile(t)
+	defer cleanup()
+
+	x := NewChunkIndex(storage, NewChunker(8<<10))
+
+	_, ok := x.Lookup(fi)
+	assert.False(t, ok)
+
+	var chunks []Chunk
+	assert.Eventually(t, func() bool {
+		chunks, ok = x.Lookup(fi)
+		return ok
+	}, time.Second, time.Millisecond)
+
+	expected, err := x.Chunk(fi)
+	require.NoError(t, err)
+	assert.Equal(t, expected, chunks)
+}
+
+type fakeFactotum struct{}
+
+func (fakeFactotum) FileSign(hash upspin.DEHash) (upspin.Signature, error) {
+	return upspin.Signature{R: big.NewInt(1), S: big.NewInt(2)}, nil
+}
+
+func (fakeFactotum) DirEntryHash(n, l upspin.PathName, a upspin.Attribute, p upspin.Packing,
+	t upspin.Time, dkey, hash []byte) upspin.DEHash {
+	return nil
+}
+
+func TestChunkedEntriesAreCachedOnceChunked(t *testing.T) {
+	storage, fi, cleanup := newChunkedFile(t)
+	defer cleanup()
+
+	x := NewChunkIndex(storage, NewChunker(8<<10))
+	cache := NewCache(Chunked{Index: x}, 10)
+
+	// Until the file is chunked, its entry holds fixed-size blocks.
+	de, err := cache.DirEntry("test.user@some-mail.com", fi, fakeFactotum{})
+	require.NoError(t, err)
+	require.Len(t, de.Blocks, 1)
+	assert.Equal(t, Ref(fi.Filename, 0, upspin.BlockSize), de.Blocks[0].Location.Reference)
+
+	assert.Eventually(t, func() bool {
+		_, ok := x.Lookup(fi)
+		return ok
+	}, time.Second, time.Millisecond)
+
+	de, err = cache.DirEntry("test.user@some-mail.com", fi, fakeFactotum{})
+	require.NoError(t, err)
+	require.True(t, len(de.Blocks) > 1)
+	for _, b := range de.Blocks {
+		_, ok := ParseChunkRef(b.Location.Reference)
+		assert.True(t, ok)
+	}
+
+	_, misses := cache.Stats()
+	assert.Equal(t, uint64(2), misses)
+	cached, err := cache.DirEntry("test.user@some-mail.com", fi, fakeFactotum{})
+	require.NoError(t, err)
+	assert.Equal(t, de, cached)
+	_, misses = cache.Stats()
+	assert.Equal(t, uint64(2), misses)
+}
@@ -0,0 +1,145 @@
+package packing
+
+import (
+	"crypto/sha256"
+	"io"
+	"math/bits"
+
+	"upspin.io/errors"
+)
+
+// Chunker cuts data in chunks of variable size at boundaries defined by
+// their content, using the FastCDC algorithm: a rolling gear hash is
+// computed over the data and a chunk ends where its top bits are all
+// zero. Inserting or removing bytes in a file only changes the chunks
+// around the modification, the others keep their content and their hash.
+type Chunker struct {
+	// Min, Avg and Max are the minimum, average and maximum sizes of
+	// the chunks. Avg is rounded down to a power of two.
+	Min, Avg, Max int
+}
+
+// Chunk is a part of a file cut by a Chunker.
+type Chunk struct {
+	Offset int64
+	Size   int64
+	Sum    [sha256.Size]byte
+}
+
+// NewChunker returns a Chunker of chunks of avg bytes on average, and
+// between a quarter and four times that.
+func NewChunker(avg int) Chunker {
+	max := 4 * avg
+	if max > MaxBlockSize {
+		max = MaxBlockSize
+	}
+	return Chunker{Min: avg / 4, Avg: avg, Max: max}
+}
+
+// Valid returns an error if the sizes of c can't be used.
+func (c Chunker) Valid() error {
+	if c.Min <= 0 || c.Avg < c.Min || c.Max < c.Avg || c.Max > MaxBlockSize {
+		return errors.Errorf("invalid chunk sizes %d/%d/%d: want 0 < min <= avg <= max <= %d",
+			c.Min, c.Avg, c.Max, MaxBlockSize)
+	}
+	return nil
+}
+
+// Split reads r until EOF and returns its chunks.
+func (c Chunker) Split(r io.Reader) ([]Chunk, error) {
+	if err := c.Valid(); err != nil {
+		return nil, err
+	}
+
+	var chunks []Chunk
+	buf := make([]byte, c.Max)
+	filled := 0
+	offset := int64(0)
+	eof := false
+	for {
+		if !eof {
+			n, err := io.ReadFull(r, buf[filled:])
+			filled += n
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		if filled == 0 {
+			return chunks, nil
+		}
+
+		n := c.cut(buf[:filled])
+		chunks = append(chunks, Chunk{
+			Offset: offset,
+			Size:   int64(n),
+			Sum:    sha256.Sum256(buf[:n]),
+		})
+		copy(buf, buf[n:filled])
+		filled -= n
+		offset += int64(n)
+	}
+}
+
+// cut returns the size of the chunk starting data. data holds Max bytes
+// unless it is the end of the input.
+func (c Chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.Min {
+		return n
+	}
+	if n > c.Max {
+		n = c.Max
+	}
+	normal := c.Avg
+	if normal > n {
+		normal = n
+	}
+
+	// Before the average size, a cut needs more zero bits than after
+	// it, which packs the sizes of the chunks around the average.
+	b := bits.Len(uint(c.Avg)) - 1
+	maskS, maskL := topBits(b+1), topBits(b-1)
+
+	var fp uint64
+	i := c.Min
+	for ; i < normal; i++ {
+		fp = fp<<1 + gear[data[i]]
+		if fp&maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = fp<<1 + gear[data[i]]
+		if fp&maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// topBits returns a mask of the n top bits of a uint64. With the gear
+// hash, they depend on the last 64 bytes read.
+func topBits(n int) uint64 {
+	if n <= 0 {
+		return 0
+	}
+	return ^uint64(0) << (64 - n)
+}
+
+// gear holds the random values of the bytes in the gear hash. They are
+// generated from a fixed seed so that the chunks of a file do not change
+// between runs.
+var gear = func() (table [256]uint64) {
+	x := uint64(0x5ca1ab1e)
+	for i := range table {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		table[i] = z ^ z>>31
+	}
+	return
+}()
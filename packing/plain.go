@@ -3,10 +3,10 @@ package packing
 import (
 	"crypto/sha256"
 	"encoding/binary"
-	"fmt"
 	"math/big"
 
 	"github.com/gildasch/upspin-localserver/local"
+	"upspin.io/errors"
 	"upspin.io/pack/packutil"
 	"upspin.io/upspin"
 )
@@ -27,25 +27,91 @@ type Factotum interface {
 		t upspin.Time, dkey, hash []byte) upspin.DEHash
 }
 
-type Plain struct{}
+// Plain packs the files as they are, in blocks of BlockSize bytes, or
+// upspin.BlockSize if zero, to be read from the store server at Endpoint,
+// or at defaultEndpoint if zero.
+type Plain struct {
+	BlockSize int64
+	Endpoint  upspin.Endpoint
+}
+
+// defaultEndpoint is the store server of the blocks of Plain if it has
+// no Endpoint.
+var defaultEndpoint = upspin.Endpoint{
+	Transport: upspin.Remote,
+	NetAddr:   "usl.gildas.ch",
+}
 
-func (Plain) DirEntry(username string, fi local.FileInfo, factotum Factotum) *upspin.DirEntry {
-	e := dirEntryFromFileInfo(username, fi)
+func (Plain) Packing() upspin.Packing {
+	return upspin.PlainPack
+}
+
+func (p Plain) DirEntry(username string, fi local.FileInfo, factotum Factotum) (*upspin.DirEntry, error) {
+	const op errors.Op = "packing.Plain.DirEntry"
+
+	e := dirEntryFromFileInfo(username, fi, p.endpoint(), p.blockSize())
 
 	// Compute entry signature with dkey=sum=0.
 	dkey := make([]byte, aesKeyLen)
 	sum := make([]byte, sha256.Size)
-	sig, err := factotum.FileSign(factotum.DirEntryHash(e.SignedName, e.Link, e.Attr, e.Packing, e.Time, dkey, sum))
+	hash := factotum.DirEntryHash(e.SignedName, e.Link, e.Attr, e.Packing, e.Time, dkey, sum)
+	sig, err := factotum.FileSign(hash)
 	if err != nil {
-		panic(err.Error())
+		return nil, errors.E(op, e.Name, errors.Internal, err)
 	}
 
-	pdMarshal(&e.Packdata, sig, upspin.Signature{})
+	// During a key rotation, also sign with the previous key so that
+	// clients still knowing only that one can verify the entry.
+	sig2 := upspin.Signature{}
+	if previous := previousKey(factotum); previous != nil {
+		sig2, err = previous.FileSign(hash)
+		if err != nil {
+			return nil, errors.E(op, e.Name, errors.Internal, err)
+		}
+	}
+
+	if err := pdMarshal(&e.Packdata, sig, sig2); err != nil {
+		return nil, errors.E(op, e.Name, errors.Internal, err)
+	}
 
-	return e
+	return e, nil
 }
 
-func dirEntryFromFileInfo(username string, fi local.FileInfo) *upspin.DirEntry {
+// previousKey returns a Factotum signing with the previous key of
+// factotum, or nil if it has none. Factotums loaded by upspin.io/factotum
+// from a directory holding a secret2.upspinkey file have one.
+func previousKey(factotum Factotum) Factotum {
+	f, ok := factotum.(interface {
+		PublicKey() upspin.PublicKey
+		Pop() upspin.Factotum
+	})
+	if !ok {
+		return nil
+	}
+
+	previous := f.Pop()
+	if previous == nil || previous.PublicKey() == f.PublicKey() {
+		return nil
+	}
+
+	return previous
+}
+
+func (p Plain) blockSize() int64 {
+	if p.BlockSize > 0 {
+		return p.BlockSize
+	}
+	return upspin.BlockSize
+}
+
+func (p Plain) endpoint() upspin.Endpoint {
+	if p.Endpoint != (upspin.Endpoint{}) {
+		return p.Endpoint
+	}
+	return defaultEndpoint
+}
+
+func dirEntryFromFileInfo(username string, fi local.FileInfo, endpoint upspin.Endpoint, blockSize int64) *upspin.DirEntry {
 	de := &upspin.DirEntry{
 		Name: upspin.PathName(
 			username + fi.Filename),
@@ -56,37 +122,40 @@ func dirEntryFromFileInfo(username string, fi local.FileInfo) *upspin.DirEntry {
 	if fi.IsDir {
 		de.Attr = upspin.AttrDirectory
 	} else {
-		de.Blocks = blocksFromFileInfo(fi)
+		de.Blocks = blocksFromFileInfo(fi, endpoint, blockSize)
 	}
 	return de
 }
 
-func blocksFromFileInfo(fi local.FileInfo) (dbs []upspin.DirBlock) {
+func blocksFromFileInfo(fi local.FileInfo, endpoint upspin.Endpoint, blockSize int64) (dbs []upspin.DirBlock) {
 	size := fi.Size
 	offset := int64(0)
 	for size > 0 {
-		s := int64(upspin.BlockSize)
+		s := blockSize
 		if s > size {
 			s = size
 		}
 		size -= s
-		ref := fmt.Sprintf("%s-%d", fi.Filename, offset)
-		dbs = append(dbs, upspin.DirBlock{
-			Location: upspin.Location{
-				Endpoint: upspin.Endpoint{
-					Transport: upspin.Remote,
-					NetAddr:   "usl.gildas.ch",
-				},
-				Reference: upspin.Reference(ref)},
-			Offset: offset,
-			Size:   s,
-		})
+		dbs = append(dbs, dirBlock(endpoint, Ref(fi.Filename, offset, blockSize), offset, s))
 		offset += s
 	}
 
 	return
 }
 
+// dirBlock returns the block of size bytes at offset of an entry, read
+// from the store server at endpoint with ref.
+func dirBlock(endpoint upspin.Endpoint, ref upspin.Reference, offset, size int64) upspin.DirBlock {
+	return upspin.DirBlock{
+		Location: upspin.Location{
+			Endpoint:  endpoint,
+			Reference: ref,
+		},
+		Offset: offset,
+		Size:   size,
+	}
+}
+
 func pdMarshal(dst *[]byte, sig, sig2 upspin.Signature) error {
 	// sig2 is a signature with another owner key, to enable smoother key rotation.
 	n := packdataLen()
@@ -105,7 +174,8 @@ func pdMarshal(dst *[]byte, sig, sig2 upspin.Signature) error {
 	return nil
 }
 
-// packdataLen returns n big enough for packing, sig.R, sig.S
+// packdataLen returns n big enough for packing sig.R, sig.S, sig2.R and
+// sig2.S, each preceded by its length.
 func packdataLen() int {
-	return 2*marshalBufLen + binary.MaxVarintLen64 + 1
+	return 4*marshalBufLen + 4*binary.MaxVarintLen64
 }
@@ -1,14 +1,21 @@
 package packing
 
 import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"math/big"
 	"testing"
 
 	"github.com/gildasch/upspin-localserver/local"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"upspin.io/bind"
 	"upspin.io/config"
+	"upspin.io/errors"
 	"upspin.io/factotum"
+	"upspin.io/key/keygen"
 	"upspin.io/pack"
+	"upspin.io/pack/packutil"
 	_ "upspin.io/pack/plain"
 	"upspin.io/test/testutil"
 	_ "upspin.io/transports"
@@ -25,13 +32,39 @@ func Test_PlainPackRecognizedByUnpack(t *testing.T) {
 		Size:     20,
 	}
 
-	d := Plain{}.DirEntry("test.user@some-mail.com", fi, cfg.Factotum())
+	d, err := Plain{}.DirEntry("test.user@some-mail.com", fi, cfg.Factotum())
+	assert.NoError(t, err)
 
-	_, err := pack.Lookup(upspin.PlainPack).Unpack(cfg, d)
+	_, err = pack.Lookup(upspin.PlainPack).Unpack(cfg, d)
 
 	assert.NoError(t, err)
 }
 
+type failingFactotum struct {
+	upspin.Factotum
+}
+
+func (failingFactotum) FileSign(hash upspin.DEHash) (upspin.Signature, error) {
+	return upspin.Signature{}, errors.Str("no key")
+}
+
+func Test_PlainSigningFailureReturnsError(t *testing.T) {
+	cfg, _, _, _ := newConfigAndServices(upspin.UserName("test.user@some-mail.com"))
+
+	fi := local.FileInfo{
+		Filename: "/albert.txt",
+		Dir:      ".",
+		IsDir:    false,
+		Size:     20,
+	}
+
+	d, err := Plain{}.DirEntry("test.user@some-mail.com", fi, failingFactotum{cfg.Factotum()})
+
+	assert.Nil(t, d)
+	assert.True(t, errors.Is(errors.Internal, err))
+	assert.True(t, errors.Match(errors.E(upspin.PathName("test.user@some-mail.com/albert.txt")), err))
+}
+
 func newConfigAndServices(name upspin.UserName) (cfg upspin.Config, key upspin.KeyServer, dir upspin.DirServer, store upspin.StoreServer) {
 	endpoint := upspin.Endpoint{
 		Transport: upspin.InProcess,
@@ -54,3 +87,109 @@ func newConfigAndServices(name upspin.UserName) (cfg upspin.Config, key upspin.K
 	dir, _ = bind.DirServer(cfg, cfg.KeyEndpoint())
 	return
 }
+
+type rotatingFactotum struct {
+	upspin.Factotum
+	previous upspin.Factotum
+}
+
+func (f rotatingFactotum) Pop() upspin.Factotum {
+	return f.previous
+}
+
+func Test_PlainSignsWithPreviousKeyDuringRotation(t *testing.T) {
+	cfg, _, _, _ := newConfigAndServices(upspin.UserName("test.user@some-mail.com"))
+	previous, err := factotum.NewFromDir(testutil.Repo("key", "testdata", "user2"))
+	require.NoError(t, err)
+	f := rotatingFactotum{Factotum: cfg.Factotum(), previous: previous}
+
+	fi := local.FileInfo{
+		Filename: "/albert.txt",
+		Dir:      ".",
+		IsDir:    false,
+		Size:     20,
+	}
+
+	d, err := Plain{}.DirEntry("test.user@some-mail.com", fi, f)
+	require.NoError(t, err)
+
+	sig, sig2 := pdUnmarshal(t, d.Packdata)
+	hash := f.DirEntryHash(d.SignedName, d.Link, d.Attr, d.Packing, d.Time,
+		make([]byte, aesKeyLen), make([]byte, sha256.Size))
+
+	current, _, err := factotum.ParsePublicKey(f.PublicKey())
+	require.NoError(t, err)
+	assert.True(t, ecdsa.Verify(current, hash, sig.R, sig.S))
+
+	old, _, err := factotum.ParsePublicKey(previous.PublicKey())
+	require.NoError(t, err)
+	assert.True(t, ecdsa.Verify(old, hash, sig2.R, sig2.S))
+
+	_, err = pack.Lookup(upspin.PlainPack).Unpack(cfg, d)
+	assert.NoError(t, err)
+}
+
+func Test_PlainWithoutPreviousKeyHasZeroSig2(t *testing.T) {
+	cfg, _, _, _ := newConfigAndServices(upspin.UserName("test.user@some-mail.com"))
+
+	fi := local.FileInfo{
+		Filename: "/albert.txt",
+		Dir:      ".",
+		IsDir:    false,
+		Size:     20,
+	}
+
+	d, err := Plain{}.DirEntry("test.user@some-mail.com", fi, cfg.Factotum())
+	require.NoError(t, err)
+
+	_, sig2 := pdUnmarshal(t, d.Packdata)
+	assert.Equal(t, 0, sig2.R.Sign())
+	assert.Equal(t, 0, sig2.S.Sign())
+}
+
+func newP521Factotum(t *testing.T) upspin.Factotum {
+	public, private, _, err := keygen.Generate("p521")
+	require.NoError(t, err)
+	f, err := factotum.NewFromKeys([]byte(public), []byte(private), nil)
+	require.NoError(t, err)
+	return f
+}
+
+func Test_PlainSignsWithP521KeysDuringRotation(t *testing.T) {
+	f := rotatingFactotum{Factotum: newP521Factotum(t), previous: newP521Factotum(t)}
+
+	fi := local.FileInfo{
+		Filename: "/albert.txt",
+		Dir:      ".",
+		IsDir:    false,
+		Size:     20,
+	}
+
+	d, err := Plain{}.DirEntry("test.user@some-mail.com", fi, f)
+	require.NoError(t, err)
+
+	sig, sig2 := pdUnmarshal(t, d.Packdata)
+	hash := f.DirEntryHash(d.SignedName, d.Link, d.Attr, d.Packing, d.Time,
+		make([]byte, aesKeyLen), make([]byte, sha256.Size))
+
+	current, _, err := factotum.ParsePublicKey(f.PublicKey())
+	require.NoError(t, err)
+	assert.True(t, ecdsa.Verify(current, hash, sig.R, sig.S))
+
+	old, _, err := factotum.ParsePublicKey(f.previous.PublicKey())
+	require.NoError(t, err)
+	assert.True(t, ecdsa.Verify(old, hash, sig2.R, sig2.S))
+}
+
+func pdUnmarshal(t *testing.T, pd []byte) (sig, sig2 upspin.Signature) {
+	values := []*big.Int{}
+	for i := 0; i < 4; i++ {
+		b, n := packutil.GetBytes(pd)
+		require.NotZero(t, n)
+		values = append(values, new(big.Int).SetBytes(b))
+		pd = pd[n:]
+	}
+
+	return upspin.Signature{R: values[0], S: values[1]},
+		upspin.Signature{R: values[2], S: values[3]}
+}
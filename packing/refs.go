@@ -0,0 +1,50 @@
+package packing
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// MaxBlockSize is the largest block size the references can hold.
+const MaxBlockSize = 16 << 20
+
+// Ref returns the reference of the block of filename at offset, for
+// blocks of blockSize. References of blocks of upspin.BlockSize keep the
+// "filename-offset" form, others are "filename-offset:blockSize".
+func Ref(filename string, offset, blockSize int64) upspin.Reference {
+	if blockSize == upspin.BlockSize {
+		return upspin.Reference(fmt.Sprintf("%s-%d", filename, offset))
+	}
+	return upspin.Reference(fmt.Sprintf("%s-%d:%d", filename, offset, blockSize))
+}
+
+// ParseRef returns the file name, offset and block size of the block
+// referenced by ref. References without a block size are blocks of
+// upspin.BlockSize.
+func ParseRef(ref upspin.Reference) (filename string, offset, blockSize int64, err error) {
+	i := strings.LastIndex(string(ref), "-")
+	if i < 0 {
+		return "", 0, 0, errors.Errorf("invalid reference %q", ref)
+	}
+	filename, block := string(ref[:i]), string(ref[i+1:])
+
+	blockSize = upspin.BlockSize
+	if j := strings.Index(block, ":"); j >= 0 {
+		blockSize, err = strconv.ParseInt(block[j+1:], 10, 64)
+		if err != nil || blockSize <= 0 || blockSize > MaxBlockSize {
+			return "", 0, 0, errors.Errorf("invalid block size in reference %q", ref)
+		}
+		block = block[:j]
+	}
+
+	offset, err = strconv.ParseInt(block, 10, 64)
+	if err != nil {
+		return "", 0, 0, errors.Errorf("invalid offset in reference %q", ref)
+	}
+
+	return filename, offset, blockSize, nil
+}
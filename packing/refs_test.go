@@ -0,0 +1,75 @@
+package packing
+
+import (
+	"testing"
+
+	"github.com/gildasch/upspin-localserver/local"
+	"github.com/stretchr/testify/assert"
+	"upspin.io/upspin"
+)
+
+func TestRefRoundTrip(t *testing.T) {
+	cases := []struct {
+		filename  string
+		offset    int64
+		blockSize int64
+		ref       upspin.Reference
+	}{
+		{"/a.txt", 0, upspin.BlockSize, "/a.txt-0"},
+		{"/a-b.txt", 2 * upspin.BlockSize, upspin.BlockSize, "/a-b.txt-2097152"},
+		{"/a-b.txt", 8192, 4096, "/a-b.txt-8192:4096"},
+		{"/a:b-c.txt", 0, MaxBlockSize, "/a:b-c.txt-0:16777216"},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.ref, Ref(c.filename, c.offset, c.blockSize))
+
+		filename, offset, blockSize, err := ParseRef(c.ref)
+		assert.NoError(t, err)
+		assert.Equal(t, c.filename, filename)
+		assert.Equal(t, c.offset, offset)
+		assert.Equal(t, c.blockSize, blockSize)
+	}
+}
+
+func TestParseRefErrors(t *testing.T) {
+	for _, ref := range []upspin.Reference{
+		"noblock",
+		"/a.txt-",
+		"/a.txt-x",
+		"/a.txt-0:",
+		"/a.txt-0:0",
+		"/a.txt-0:16777217",
+		"/a.txt-x:4096",
+	} {
+		_, _, _, err := ParseRef(ref)
+		assert.Error(t, err, ref)
+	}
+}
+
+func TestBlocksFromFileInfo(t *testing.T) {
+	fi := local.FileInfo{Filename: "/a.txt", Size: 10000}
+
+	blocks := blocksFromFileInfo(fi, defaultEndpoint, 4096)
+
+	if assert.Len(t, blocks, 3) {
+		for i, b := range blocks {
+			assert.Equal(t, int64(i)*4096, b.Offset)
+			assert.Equal(t, Ref("/a.txt", b.Offset, 4096), b.Location.Reference)
+		}
+		assert.Equal(t, int64(4096), blocks[0].Size)
+		assert.Equal(t, int64(10000-2*4096), blocks[2].Size)
+	}
+
+	blocks = blocksFromFileInfo(fi, Plain{}.endpoint(), Plain{}.blockSize())
+	if assert.Len(t, blocks, 1) {
+		assert.Equal(t, upspin.Reference("/a.txt-0"), blocks[0].Location.Reference)
+		assert.Equal(t, upspin.NetAddr("usl.gildas.ch"), blocks[0].Location.Endpoint.NetAddr)
+	}
+
+	endpoint := upspin.Endpoint{Transport: upspin.Remote, NetAddr: "store.example.com:443"}
+	blocks = blocksFromFileInfo(fi, Plain{Endpoint: endpoint}.endpoint(), upspin.BlockSize)
+	if assert.Len(t, blocks, 1) {
+		assert.Equal(t, endpoint, blocks[0].Location.Endpoint)
+	}
+}
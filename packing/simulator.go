@@ -6,5 +6,5 @@ import (
 )
 
 type Simulator interface {
-	DirEntry(username string, fi local.FileInfo, factotum Factotum) *upspin.DirEntry
+	DirEntry(username string, fi local.FileInfo, factotum Factotum) (*upspin.DirEntry, error)
 }
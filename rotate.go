@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"upspin.io/key/keygen"
+)
+
+// rotate generates a new key pair for the server user, keeping the
+// current one as the previous key. Until the new public key is
+// registered on the key server and the clients have noticed it, the
+// entries are signed with both keys.
+func rotate(args []string) {
+	fs := flag.NewFlagSet("rotate", flag.ExitOnError)
+	secretsPtr := fs.String("secrets", defaultSecrets,
+		"the directory holding the keys of the server user")
+	curvePtr := fs.String("curve", "p256",
+		"the elliptic curve of the new keys: p256, p384 or p521")
+	fs.Parse(args)
+
+	if err := rotateKeys(*secretsPtr, *curvePtr); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not rotate keys: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf(`New keys written to %s, the previous ones were moved to secret2.upspinkey.
+
+To finish the rotation:
+ 1. restart the server, it will sign entries with both keys;
+ 2. register the new public key on the key server:
+      upspin -config <config of the server user> user -put
+ 3. once the clients have picked up the new key, remove the previous
+    one from secret2.upspinkey and restart the server.
+`, *secretsPtr)
+}
+
+func rotateKeys(secrets, curve string) error {
+	if _, err := os.Stat(secrets); err != nil {
+		return err
+	}
+
+	public, private, proquint, err := keygen.Generate(curve)
+	if err != nil {
+		return err
+	}
+
+	return keygen.SaveKeys(secrets, true, public, private, proquint)
+}
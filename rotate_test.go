@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"upspin.io/factotum"
+	"upspin.io/key/keygen"
+)
+
+func TestRotateKeys(t *testing.T) {
+	secrets, err := ioutil.TempDir("", "rotate")
+	require.NoError(t, err)
+	defer os.RemoveAll(secrets)
+
+	public, private, proquint, err := keygen.Generate("p256")
+	require.NoError(t, err)
+	require.NoError(t, keygen.SaveKeys(secrets, false, public, private, proquint))
+
+	require.NoError(t, rotateKeys(secrets, "p256"))
+
+	_, err = os.Stat(filepath.Join(secrets, "secret2.upspinkey"))
+	assert.NoError(t, err)
+
+	f, err := factotum.NewFromDir(secrets)
+	require.NoError(t, err)
+	assert.NotEqual(t, public, string(f.PublicKey()))
+	assert.Equal(t, public, string(f.Pop().PublicKey()))
+}
+
+func TestRotateKeysMissingDirectory(t *testing.T) {
+	assert.Error(t, rotateKeys("/nonexistent/secrets", "p256"))
+}
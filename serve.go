@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// serve serves srv on ln until a signal is received on stop. It then
+// stops accepting connections, waits up to drain for the requests in
+// flight to finish and closes closers.
+func serve(srv *http.Server, ln net.Listener, stop <-chan os.Signal, drain time.Duration, closers ...io.Closer) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(ln)
+	}()
+
+	var err error
+	select {
+	case err = <-errc:
+	case sig := <-stop:
+		logger.Info("shutting down", "signal", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), drain)
+		defer cancel()
+		if err = srv.Shutdown(ctx); err != nil {
+			err = fmt.Errorf("could not drain requests in %v: %v", drain, err)
+			srv.Close()
+		}
+	}
+
+	for _, c := range closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
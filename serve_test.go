@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type closeRecorder struct {
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestServeDrainsRequestsInFlight(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})}
+
+	stop := make(chan os.Signal, 1)
+	closer := &closeRecorder{}
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(srv, ln, stop, time.Second, closer)
+	}()
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		body <- string(data)
+	}()
+
+	<-started
+	stop <- syscall.SIGTERM
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	assert.Equal(t, "done", <-body)
+	assert.NoError(t, <-served)
+	assert.True(t, closer.closed)
+
+	_, err = http.Get("http://" + ln.Addr().String())
+	assert.Error(t, err)
+}
+
+func TestServeDrainTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})}
+
+	stop := make(chan os.Signal, 1)
+	closer := &closeRecorder{}
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(srv, ln, stop, 10*time.Millisecond, closer)
+	}()
+
+	go http.Get("http://" + ln.Addr().String())
+
+	<-started
+	stop <- syscall.SIGINT
+
+	assert.Error(t, <-served)
+	assert.True(t, closer.closed)
+}
+
+func TestServeListenerFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ln.Close()
+
+	closer := &closeRecorder{}
+	err = serve(&http.Server{}, ln, make(chan os.Signal), time.Second, closer)
+
+	assert.Error(t, err)
+	assert.True(t, closer.closed)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"upspin.io/bind"
+	"upspin.io/config"
+	"upspin.io/factotum"
+	"upspin.io/key/keygen"
+	"upspin.io/upspin"
+	"upspin.io/user"
+	"upspin.io/valid"
+)
+
+// setupOptions describe the identity of the server user to create.
+type setupOptions struct {
+	user      upspin.UserName
+	secrets   string
+	config    string
+	addr      upspin.NetAddr
+	keyServer string
+	curve     string
+}
+
+// setup generates the keys and the config file of a new server user,
+// and either registers it on the key server or prints how to do so.
+func setup(args []string) {
+	home := os.Getenv("HOME")
+
+	fs := flag.NewFlagSet("setup", flag.ExitOnError)
+	userPtr := fs.String("user", "",
+		"the name of the server user, possibly with a +suffix")
+	secretsPtr := fs.String("secrets", "",
+		"the directory to write the keys to (default $HOME/.ssh/<user>)")
+	configPtr := fs.String("config", "",
+		"the config file to write (default $HOME/upspin/config.<user>)")
+	addrPtr := fs.String("addr", "",
+		"the address clients reach the server at, as host:port")
+	keyServerPtr := fs.String("keyserver", "remote,key.upspin.io:443",
+		"the key server endpoint")
+	curvePtr := fs.String("curve", "p256",
+		"the elliptic curve of the keys: p256, p384 or p521")
+	registerPtr := fs.String("register-as", "",
+		"if set, the config file of the user registering the new one on the key server: the base user for a +suffix user, or the user itself")
+	fs.Parse(args)
+
+	opts := setupOptions{
+		user:      upspin.UserName(*userPtr),
+		secrets:   *secretsPtr,
+		config:    *configPtr,
+		addr:      upspin.NetAddr(*addrPtr),
+		keyServer: *keyServerPtr,
+		curve:     *curvePtr,
+	}
+	if opts.secrets == "" {
+		opts.secrets = filepath.Join(home, ".ssh", *userPtr)
+	}
+	if opts.config == "" {
+		opts.config = filepath.Join(home, "upspin", "config."+*userPtr)
+	}
+
+	u, err := setupUser(opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not set up the server user: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *registerPtr != "" {
+		cfg, err := config.FromFile(*registerPtr)
+		if err == nil {
+			err = registerUser(cfg, u)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not register %s: %v\n", u.Name, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Registered %s on the key server.\n", u.Name)
+	}
+
+	fmt.Print(registrationSteps(opts, u, *registerPtr != ""))
+}
+
+// setupUser writes the keys of the user to the secrets directory and
+// its upspin config file, and returns the record to register on the
+// key server.
+func setupUser(opts setupOptions) (*upspin.User, error) {
+	if err := valid.UserName(opts.user); err != nil {
+		return nil, err
+	}
+	if opts.addr == "" {
+		return nil, errors.New("the address of the server must be set")
+	}
+
+	if _, err := os.Stat(filepath.Join(opts.secrets, "secret.upspinkey")); err == nil {
+		return nil, errors.Errorf("keys already exist in %s, use the rotate subcommand to replace them", opts.secrets)
+	}
+	if err := os.MkdirAll(opts.secrets, 0700); err != nil {
+		return nil, errors.Wrap(err, "could not create the secrets directory")
+	}
+
+	public, private, proquint, err := keygen.Generate(opts.curve)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not generate keys")
+	}
+	if err := keygen.SaveKeys(opts.secrets, false, public, private, proquint); err != nil {
+		return nil, errors.Wrap(err, "could not save keys")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(opts.config), 0755); err != nil {
+		return nil, errors.Wrap(err, "could not create the config directory")
+	}
+	if err := ioutil.WriteFile(opts.config, []byte(configFile(opts)), 0644); err != nil {
+		return nil, errors.Wrap(err, "could not write the config file")
+	}
+
+	endpoint := upspin.Endpoint{Transport: upspin.Remote, NetAddr: opts.addr}
+	return &upspin.User{
+		Name:      opts.user,
+		Dirs:      []upspin.Endpoint{endpoint},
+		Stores:    []upspin.Endpoint{endpoint},
+		PublicKey: upspin.PublicKey(public),
+	}, nil
+}
+
+// registerUser puts the record u on the key server of cfg, on behalf of
+// the user of cfg.
+func registerUser(cfg upspin.Config, u *upspin.User) error {
+	if _, _, err := factotum.ParsePublicKey(u.PublicKey); err != nil {
+		return err
+	}
+
+	key, err := bind.KeyServer(cfg, cfg.KeyEndpoint())
+	if err != nil {
+		return err
+	}
+
+	return key.Put(u)
+}
+
+func configFile(opts setupOptions) string {
+	return fmt.Sprintf(`username: %s
+secrets: %s
+packing: plain
+keyserver: %s
+dirserver: remote,%s
+storeserver: remote,%s
+`, opts.user, opts.secrets, opts.keyServer, opts.addr, opts.addr)
+}
+
+func registrationSteps(opts setupOptions, u *upspin.User, registered bool) string {
+	steps := fmt.Sprintf(`Keys written to %s.
+Config written to %s.
+
+`, opts.secrets, opts.config)
+
+	if !registered {
+		base, suffix, domain, _ := user.Parse(u.Name)
+		if suffix != "" {
+			steps += fmt.Sprintf(`To register %s, run as the base user %s@%s:
+  upspin user -put -in <file>
+with <file> holding:
+%s
+`, u.Name, strings.SplitN(base, "+", 2)[0], domain, userRecord(u))
+		} else {
+			steps += fmt.Sprintf(`To register %s, follow the upspin signup process
+(https://upspin.io/doc/signup.md) using the keys in %s.
+`, u.Name, opts.secrets)
+		}
+	}
+
+	steps += fmt.Sprintf(`
+Then start the server with:
+  %s -config %s -root <directory to serve>
+`, os.Args[0], opts.config)
+
+	return steps
+}
+
+func userRecord(u *upspin.User) string {
+	key := strings.Split(strings.TrimSpace(string(u.PublicKey)), "\n")
+	return fmt.Sprintf(`name: %s
+dirs:
+  - remote,%s
+stores:
+  - remote,%s
+publickey: |
+  %s
+`, u.Name, u.Dirs[0].NetAddr, u.Stores[0].NetAddr, strings.Join(key, "\n  "))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"upspin.io/bind"
+	"upspin.io/config"
+	"upspin.io/key/inprocess"
+	"upspin.io/upspin"
+)
+
+func TestSetupUser(t *testing.T) {
+	dir := t.TempDir()
+	opts := setupOptions{
+		user:      "server+local@example.com",
+		secrets:   filepath.Join(dir, "secrets"),
+		config:    filepath.Join(dir, "upspin", "config"),
+		addr:      "usl.example.com:443",
+		keyServer: "inprocess",
+		curve:     "p256",
+	}
+
+	u, err := setupUser(opts)
+	require.NoError(t, err)
+
+	assert.Equal(t, upspin.UserName("server+local@example.com"), u.Name)
+	assert.Equal(t, []upspin.Endpoint{{Transport: upspin.Remote, NetAddr: "usl.example.com:443"}}, u.Dirs)
+	assert.Equal(t, u.Dirs, u.Stores)
+
+	cfg, err := config.FromFile(opts.config)
+	require.NoError(t, err)
+	assert.Equal(t, u.Name, cfg.UserName())
+	assert.Equal(t, upspin.PlainPack, cfg.Packing())
+	assert.Equal(t, u.Dirs[0], cfg.DirEndpoint())
+	require.NotNil(t, cfg.Factotum())
+	assert.Equal(t, u.PublicKey, cfg.Factotum().PublicKey())
+
+	_, err = setupUser(opts)
+	assert.Error(t, err, "existing keys must not be overwritten")
+}
+
+func TestSetupUserInvalid(t *testing.T) {
+	dir := t.TempDir()
+	opts := setupOptions{
+		user:      "not a user",
+		secrets:   filepath.Join(dir, "secrets"),
+		config:    filepath.Join(dir, "upspin", "config"),
+		addr:      "usl.example.com:443",
+		keyServer: "inprocess",
+		curve:     "p256",
+	}
+
+	_, err := setupUser(opts)
+	assert.Error(t, err)
+
+	opts.user = "server@example.com"
+	opts.addr = ""
+	_, err = setupUser(opts)
+	assert.Error(t, err)
+}
+
+var inProcessKeyServer sync.Once
+
+// registerInProcessKeyServer binds the in-process key server, once for
+// all the tests.
+func registerInProcessKeyServer(t *testing.T) {
+	inProcessKeyServer.Do(func() {
+		require.NoError(t, bind.RegisterKeyServer(upspin.InProcess, inprocess.New()))
+	})
+}
+
+func TestRegisterUserOnInProcessKeyServer(t *testing.T) {
+	registerInProcessKeyServer(t)
+
+	dir := t.TempDir()
+	opts := setupOptions{
+		user:      "server@example.com",
+		secrets:   filepath.Join(dir, "secrets"),
+		config:    filepath.Join(dir, "upspin", "config"),
+		addr:      "usl.example.com:443",
+		keyServer: "inprocess",
+		curve:     "p256",
+	}
+
+	u, err := setupUser(opts)
+	require.NoError(t, err)
+
+	cfg, err := config.FromFile(opts.config)
+	require.NoError(t, err)
+	cfg = config.SetKeyEndpoint(cfg, upspin.Endpoint{Transport: upspin.InProcess})
+
+	require.NoError(t, registerUser(cfg, u))
+
+	key, err := bind.KeyServer(cfg, cfg.KeyEndpoint())
+	require.NoError(t, err)
+	registered, err := key.Lookup(u.Name)
+	require.NoError(t, err)
+	assert.Equal(t, u.PublicKey, registered.PublicKey)
+	assert.Equal(t, u.Dirs, registered.Dirs)
+}
+
+func TestRegistrationSteps(t *testing.T) {
+	dir := t.TempDir()
+	opts := setupOptions{
+		user:      "server+local@example.com",
+		secrets:   filepath.Join(dir, "secrets"),
+		config:    filepath.Join(dir, "upspin", "config"),
+		addr:      "usl.example.com:443",
+		keyServer: "inprocess",
+		curve:     "p256",
+	}
+
+	u := &upspin.User{
+		Name:      opts.user,
+		Dirs:      []upspin.Endpoint{{Transport: upspin.Remote, NetAddr: opts.addr}},
+		Stores:    []upspin.Endpoint{{Transport: upspin.Remote, NetAddr: opts.addr}},
+		PublicKey: "p256\n1234\n5678\n",
+	}
+
+	steps := registrationSteps(opts, u, false)
+	assert.Contains(t, steps, "run as the base user server@example.com")
+	assert.Contains(t, steps, "publickey: |\n  p256\n  1234\n  5678\n")
+
+	steps = registrationSteps(opts, u, true)
+	assert.False(t, strings.Contains(steps, "upspin user -put"))
+	assert.Contains(t, steps, "-config "+opts.config)
+}
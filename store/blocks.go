@@ -0,0 +1,250 @@
+package store
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/gildasch/upspin-localserver/local"
+	"upspin.io/errors"
+)
+
+// maxSequences is the number of files whose last block read is kept to
+// detect sequential reads.
+const maxSequences = 10000
+
+// BlockCache keeps blocks in memory, up to a total size, and when the
+// blocks of a file are read one after the other, reads the next ones in
+// the background. Blocks are identified by the version of their file, so
+// that a modified file is read again.
+type BlockCache struct {
+	maxBytes int64
+	ahead    int
+
+	mu       sync.Mutex
+	ll       *list.List
+	items    map[blockKey]*list.Element
+	bytes    int64
+	inflight map[blockKey]chan struct{}
+	last     map[string]int64
+
+	hits, misses, prefetched uint64
+}
+
+// fileVersion identifies the content of a file.
+type fileVersion struct {
+	name string
+	size int64
+	time int64
+	ino  uint64
+}
+
+type blockKey struct {
+	fileVersion
+	offset int64
+	size   int64
+}
+
+type cachedBlock struct {
+	key  blockKey
+	data []byte
+}
+
+// readFunc reads the block of size bytes of the file name at offset.
+type readFunc func(name string, offset, size int64) ([]byte, error)
+
+// acquireFunc reserves a read ahead, and returns a function to call with
+// the number of bytes read once done, or false if it can't be done now.
+type acquireFunc func() (release func(n int), ok bool)
+
+// NewBlockCache returns a BlockCache keeping up to maxBytes of blocks and
+// reading up to ahead blocks in advance.
+func NewBlockCache(maxBytes int64, ahead int) *BlockCache {
+	return &BlockCache{
+		maxBytes: maxBytes,
+		ahead:    ahead,
+		ll:       list.New(),
+		items:    map[blockKey]*list.Element{},
+		inflight: map[blockKey]chan struct{}{},
+		last:     map[string]int64{},
+	}
+}
+
+// Read returns a copy of the block of size bytes of the file name of
+// storage at offset, reading it with read if it is not cached. Each block
+// read in advance is first reserved with acquire, if set, and the read
+// ahead stops at the first one refused.
+// Storages not telling the version of files are always read.
+func (c *BlockCache) Read(storage Storage, name string, offset, size int64, read readFunc, acquire acquireFunc) ([]byte, error) {
+	st, ok := storage.(statter)
+	if !ok {
+		return read(name, offset, size)
+	}
+
+	fi, err := st.Stat(name)
+	if err != nil || fi.IsDir {
+		return nil, errors.E(errors.NotExist)
+	}
+	version := versionOf(name, fi)
+	key := blockKey{fileVersion: version, offset: offset, size: size}
+
+	c.mu.Lock()
+	sequential := c.sequentialLocked(name, offset, size)
+	c.mu.Unlock()
+	if sequential {
+		c.prefetch(version, offset, size, read, acquire)
+	}
+
+	for {
+		c.mu.Lock()
+		if e, ok := c.items[key]; ok {
+			c.ll.MoveToFront(e)
+			c.hits++
+			data := copyBlock(e.Value.(*cachedBlock).data)
+			c.mu.Unlock()
+			return data, nil
+		}
+		wait, ok := c.inflight[key]
+		if !ok {
+			c.misses++
+			c.mu.Unlock()
+			break
+		}
+		c.mu.Unlock()
+		// The block is being read in advance, wait for it.
+		<-wait
+	}
+
+	data, err := read(name, offset, size)
+	if err != nil {
+		return nil, err
+	}
+	c.add(key, data)
+
+	return copyBlock(data), nil
+}
+
+// Invalidate drops the blocks of the file name.
+func (c *BlockCache) Invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for e := c.ll.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*cachedBlock).key.name == name {
+			c.removeLocked(e)
+		}
+		e = next
+	}
+	delete(c.last, name)
+}
+
+// Stats returns the number of blocks found in the cache, not found and
+// read in advance.
+func (c *BlockCache) Stats() (hits, misses, prefetched uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.hits, c.misses, c.prefetched
+}
+
+// Bytes returns the size of the blocks in the cache.
+func (c *BlockCache) Bytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.bytes
+}
+
+// sequentialLocked records that the block of size bytes of name at
+// offset is read, and reports whether it follows the previous one read.
+func (c *BlockCache) sequentialLocked(name string, offset, size int64) bool {
+	last, ok := c.last[name]
+	if len(c.last) >= maxSequences && !ok {
+		c.last = map[string]int64{}
+	}
+	c.last[name] = offset
+
+	return ok && offset == last+size
+}
+
+// prefetch reads in the background the blocks of size bytes of version
+// following the one at offset, that are not cached or being read yet.
+func (c *BlockCache) prefetch(version fileVersion, offset, size int64, read readFunc, acquire acquireFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := 1; i <= c.ahead; i++ {
+		key := blockKey{fileVersion: version, offset: offset + int64(i)*size, size: size}
+		if key.offset >= version.size {
+			break
+		}
+		if _, ok := c.items[key]; ok {
+			continue
+		}
+		if _, ok := c.inflight[key]; ok {
+			continue
+		}
+
+		release := func(int) {}
+		if acquire != nil {
+			var ok bool
+			if release, ok = acquire(); !ok {
+				break
+			}
+		}
+
+		done := make(chan struct{})
+		c.inflight[key] = done
+		go func(key blockKey) {
+			data, err := read(key.name, key.offset, key.size)
+			release(len(data))
+
+			// The block is added before the reads waiting for it are
+			// released, so that they find it.
+			if err == nil {
+				c.add(key, data)
+			}
+			c.mu.Lock()
+			delete(c.inflight, key)
+			if err == nil {
+				c.prefetched++
+			}
+			c.mu.Unlock()
+			close(done)
+		}(key)
+	}
+}
+
+func (c *BlockCache) add(key blockKey, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if int64(len(data)) > c.maxBytes {
+		return
+	}
+	if _, ok := c.items[key]; ok {
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&cachedBlock{key: key, data: data})
+	c.bytes += int64(len(data))
+	for c.bytes > c.maxBytes {
+		c.removeLocked(c.ll.Back())
+	}
+}
+
+func (c *BlockCache) removeLocked(e *list.Element) {
+	b := c.ll.Remove(e).(*cachedBlock)
+	delete(c.items, b.key)
+	c.bytes -= int64(len(b.data))
+}
+
+func versionOf(name string, fi local.FileInfo) fileVersion {
+	return fileVersion{name: name, size: fi.Size, time: fi.Time.UnixNano(), ino: fi.Ino}
+}
+
+func copyBlock(data []byte) []byte {
+	cp := make([]byte, len(data))
+	copy(cp, data)
+	return cp
+}
@@ -0,0 +1,205 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gildasch/upspin-localserver/local"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"upspin.io/upspin"
+)
+
+// recordingReader reads blocks of a Store and records their offsets.
+type recordingReader struct {
+	store *Store
+
+	mu      sync.Mutex
+	offsets []int64
+}
+
+func (r *recordingReader) read(name string, offset, size int64) ([]byte, error) {
+	r.mu.Lock()
+	r.offsets = append(r.offsets, offset)
+	r.mu.Unlock()
+
+	return r.store.read(name, offset, size)
+}
+
+func (r *recordingReader) reads() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.offsets)
+}
+
+func TestBlockCacheReadsAhead(t *testing.T) {
+	dir, content, cleanup := newBigFile(t, 8)
+	defer cleanup()
+
+	storage := &local.Storage{Root: dir}
+	r := &recordingReader{store: &Store{Storage: storage}}
+	c := NewBlockCache(64<<20, 3)
+
+	read := func(i int) []byte {
+		b, err := c.Read(storage, "big", int64(i)*upspin.BlockSize, upspin.BlockSize, r.read, nil)
+		require.NoError(t, err)
+		return b
+	}
+
+	assert.Equal(t, content[:upspin.BlockSize], read(0))
+	assert.Equal(t, 1, r.reads(), "a single read is not sequential")
+
+	assert.Equal(t, content[upspin.BlockSize:2*upspin.BlockSize], read(1))
+	assert.Eventually(t, func() bool { return r.reads() == 5 }, time.Second, time.Millisecond,
+		"blocks 2 to 4 are read in advance")
+
+	for i := 2; i <= 4; i++ {
+		assert.Equal(t, content[i*upspin.BlockSize:(i+1)*upspin.BlockSize], read(i))
+	}
+	assert.Eventually(t, func() bool {
+		_, _, prefetched := c.Stats()
+		return prefetched == 6
+	}, time.Second, time.Millisecond, "blocks 5 to 7 are read in advance")
+
+	hits, misses, _ := c.Stats()
+	assert.Equal(t, uint64(3), hits)
+	assert.Equal(t, uint64(2), misses)
+	assert.Equal(t, 8, r.reads())
+
+	// The read ahead stops at the end of the file.
+	for i := 5; i <= 8; i++ {
+		read(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 9, r.reads())
+}
+
+func TestBlockCacheReturnsCopies(t *testing.T) {
+	dir, _, cleanup := newBigFile(t, 0)
+	defer cleanup()
+
+	storage := &local.Storage{Root: dir}
+	r := &recordingReader{store: &Store{Storage: storage}}
+	c := NewBlockCache(1<<20, 0)
+
+	b, err := c.Read(storage, "big", 0, upspin.BlockSize, r.read, nil)
+	require.NoError(t, err)
+	b[0] = 'y'
+
+	b, err = c.Read(storage, "big", 0, upspin.BlockSize, r.read, nil)
+	require.NoError(t, err)
+	assert.Equal(t, byte('x'), b[0])
+	assert.Equal(t, 1, r.reads())
+}
+
+func TestBlockCacheEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a", "b", "c"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), bytes.Repeat([]byte(name), 100), 0644))
+	}
+
+	storage := &local.Storage{Root: dir}
+	r := &recordingReader{store: &Store{Storage: storage}}
+	c := NewBlockCache(250, 0)
+
+	for _, name := range []string{"a", "b", "c", "c", "b", "a"} {
+		_, err := c.Read(storage, name, 0, upspin.BlockSize, r.read, nil)
+		require.NoError(t, err)
+	}
+
+	// a was evicted when c was added.
+	assert.Equal(t, []int64{0, 0, 0, 0}, r.offsets)
+	assert.Equal(t, int64(200), c.Bytes())
+}
+
+func TestBlockCacheInvalidation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(name, []byte("first"), 0644))
+
+	storage := &local.Storage{Root: dir}
+	r := &recordingReader{store: &Store{Storage: storage}}
+	c := NewBlockCache(1<<20, 0)
+
+	b, err := c.Read(storage, "file", 0, upspin.BlockSize, r.read, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(b))
+
+	// A modified file is read again.
+	require.NoError(t, ioutil.WriteFile(name, []byte("second"), 0644))
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(name, later, later))
+
+	b, err = c.Read(storage, "file", 0, upspin.BlockSize, r.read, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(b))
+	assert.Equal(t, 2, r.reads())
+
+	c.Invalidate("file")
+	assert.Equal(t, int64(0), c.Bytes())
+	_, err = c.Read(storage, "file", 0, upspin.BlockSize, r.read, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 3, r.reads())
+}
+
+func TestGetWithBlockCache(t *testing.T) {
+	dir, content, cleanup := newBigFile(t, 3)
+	defer cleanup()
+
+	store := Store{
+		Storage: &local.Storage{Root: dir},
+		Handles: NewHandles(4),
+		Blocks:  NewBlockCache(16<<20, 2),
+	}
+
+	read := []byte{}
+	for offset := 0; offset < len(content); offset += upspin.BlockSize {
+		b, _, _, err := store.Get(upspin.Reference("big-" + strconv.Itoa(offset)))
+		require.NoError(t, err)
+		read = append(read, b...)
+	}
+	assert.Equal(t, content, read)
+
+	_, _, _, err := store.Get("missing-0")
+	assert.Error(t, err)
+}
+
+func TestBlockCacheReadsAheadBlocksOfTheirSize(t *testing.T) {
+	dir, content, cleanup := newBigFile(t, 1)
+	defer cleanup()
+
+	storage := &local.Storage{Root: dir}
+	r := &recordingReader{store: &Store{Storage: storage}}
+	c := NewBlockCache(64<<20, 2)
+
+	const size = 1000
+	for i := int64(0); i < 2; i++ {
+		b, err := c.Read(storage, "big", i*size, size, r.read, nil)
+		require.NoError(t, err)
+		assert.Equal(t, content[i*size:(i+1)*size], b)
+	}
+	assert.Eventually(t, func() bool { return r.reads() == 4 }, time.Second, time.Millisecond)
+
+	r.mu.Lock()
+	assert.ElementsMatch(t, []int64{0, 1000, 2000, 3000}, r.offsets)
+	r.mu.Unlock()
+
+	// The same offset read with another block size is another block.
+	b, err := c.Read(storage, "big", 2000, 10, r.read, nil)
+	require.NoError(t, err)
+	assert.Equal(t, content[2000:2010], b)
+	assert.Equal(t, 5, r.reads())
+}
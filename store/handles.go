@@ -0,0 +1,144 @@
+package store
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/gildasch/upspin-localserver/local"
+	"github.com/pkg/errors"
+)
+
+// Handles keeps up to size files open, so that the blocks of a file can
+// be read one after the other without opening it each time. The files
+// are identified by their name and version, their size and modification
+// time, so that a modified file is opened again.
+type Handles struct {
+	size int
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[fileVersion]*list.Element
+}
+
+type handle struct {
+	key     fileVersion
+	file    local.File
+	refs    int
+	evicted bool
+}
+
+// statter is implemented by the Storages telling the version of files.
+type statter interface {
+	Stat(name string) (local.FileInfo, error)
+}
+
+// NewHandles returns Handles keeping up to size files open.
+func NewHandles(size int) *Handles {
+	return &Handles{
+		size:  size,
+		ll:    list.New(),
+		items: map[fileVersion]*list.Element{},
+	}
+}
+
+// Open returns the file name of storage, and a function to call once
+// done with it. Storages not telling the version of files have their
+// files opened and closed every time.
+func (h *Handles) Open(storage Storage, name string) (local.File, func(), error) {
+	st, ok := storage.(statter)
+	if !ok {
+		return openOnce(storage, name)
+	}
+
+	fi, err := st.Stat(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fi.IsDir {
+		return nil, nil, errors.Errorf("%q is a directory", name)
+	}
+	key := versionOf(name, fi)
+
+	h.mu.Lock()
+	if e, ok := h.items[key]; ok {
+		h.ll.MoveToFront(e)
+		hd := e.Value.(*handle)
+		hd.refs++
+		h.mu.Unlock()
+		return hd.file, func() { h.done(hd) }, nil
+	}
+	h.mu.Unlock()
+
+	f, err := storage.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Another Get may have opened the file meanwhile.
+	if e, ok := h.items[key]; ok {
+		f.Close()
+		h.ll.MoveToFront(e)
+		hd := e.Value.(*handle)
+		hd.refs++
+		return hd.file, func() { h.done(hd) }, nil
+	}
+
+	hd := &handle{key: key, file: f, refs: 1}
+	h.items[key] = h.ll.PushFront(hd)
+	for h.ll.Len() > h.size {
+		h.evictLocked(h.ll.Back())
+	}
+
+	return f, func() { h.done(hd) }, nil
+}
+
+// Len returns the number of files kept open.
+func (h *Handles) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.ll.Len()
+}
+
+// Close closes the files kept open once they are not used anymore.
+func (h *Handles) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for h.ll.Len() > 0 {
+		h.evictLocked(h.ll.Back())
+	}
+	return nil
+}
+
+func (h *Handles) done(hd *handle) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hd.refs--
+	if hd.evicted && hd.refs == 0 {
+		hd.file.Close()
+	}
+}
+
+// evictLocked removes e from the list, closing its file unless it is
+// being read.
+func (h *Handles) evictLocked(e *list.Element) {
+	hd := h.ll.Remove(e).(*handle)
+	delete(h.items, hd.key)
+	hd.evicted = true
+	if hd.refs == 0 {
+		hd.file.Close()
+	}
+}
+
+func openOnce(storage Storage, name string) (local.File, func(), error) {
+	f, err := storage.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, func() { f.Close() }, nil
+}
@@ -0,0 +1,226 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gildasch/upspin-localserver/local"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"upspin.io/upspin"
+)
+
+// countingStorage counts the files opened and not closed yet.
+type countingStorage struct {
+	*local.Storage
+	opened, open int
+}
+
+type countedFile struct {
+	local.File
+	s *countingStorage
+}
+
+func (f *countedFile) Close() error {
+	f.s.open--
+	return f.File.Close()
+}
+
+func (s *countingStorage) Open(name string) (local.File, error) {
+	f, err := s.Storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	s.opened++
+	s.open++
+	return &countedFile{File: f, s: s}, nil
+}
+
+func newBigFile(t testing.TB, blocks int) (string, []byte, func()) {
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+
+	content := bytes.Repeat([]byte{'x'}, blocks*upspin.BlockSize+10)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "big"), content, 0644))
+
+	return dir, content, func() { os.RemoveAll(dir) }
+}
+
+func TestGetClosesFiles(t *testing.T) {
+	dir, _, cleanup := newBigFile(t, 2)
+	defer cleanup()
+
+	storage := &countingStorage{Storage: &local.Storage{Root: dir}}
+	store := Store{Storage: storage}
+
+	for _, offset := range []int{0, upspin.BlockSize, 2 * upspin.BlockSize} {
+		_, _, _, err := store.Get(upspin.Reference("big-" + strconv.Itoa(offset)))
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, 3, storage.opened)
+	assert.Equal(t, 0, storage.open)
+}
+
+func TestGetReusesHandles(t *testing.T) {
+	dir, content, cleanup := newBigFile(t, 2)
+	defer cleanup()
+
+	storage := &countingStorage{Storage: &local.Storage{Root: dir}}
+	store := Store{Storage: storage, Handles: NewHandles(4)}
+
+	read := []byte{}
+	for _, offset := range []int{0, upspin.BlockSize, 2 * upspin.BlockSize} {
+		b, _, _, err := store.Get(upspin.Reference("big-" + strconv.Itoa(offset)))
+		require.NoError(t, err)
+		read = append(read, b...)
+	}
+	assert.Equal(t, content, read)
+	assert.Equal(t, 1, storage.opened)
+	assert.Equal(t, 1, storage.open)
+
+	// A modified file is opened again.
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "big"), later, later))
+	_, _, _, err := store.Get("big-0")
+	require.NoError(t, err)
+	assert.Equal(t, 2, storage.opened)
+
+	require.NoError(t, store.Handles.Close())
+	assert.Equal(t, 0, storage.open)
+}
+
+func TestHandlesEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a", "b", "c"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644))
+	}
+
+	storage := &countingStorage{Storage: &local.Storage{Root: dir}}
+	h := NewHandles(2)
+
+	_, doneA, err := h.Open(storage, "a")
+	require.NoError(t, err)
+	_, doneB, err := h.Open(storage, "b")
+	require.NoError(t, err)
+	doneB()
+
+	// a is the least recently used but being read: it is evicted but
+	// only closed once done.
+	fc, doneC, err := h.Open(storage, "c")
+	require.NoError(t, err)
+	assert.Equal(t, 2, h.Len())
+	assert.Equal(t, 3, storage.open)
+
+	doneA()
+	assert.Equal(t, 2, storage.open)
+
+	b := make([]byte, 1)
+	_, err = fc.ReadAt(b, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "c", string(b))
+	doneC()
+
+	_, _, err = h.Open(storage, "missing")
+	assert.Error(t, err)
+	_, _, err = h.Open(storage, "/")
+	assert.Error(t, err)
+}
+
+// benchmarkSequentialGets reads a file block after block, as a client
+// copying it does.
+func benchmarkSequentialGets(b *testing.B, handles *Handles) {
+	dir, content, cleanup := newBigFile(b, 8)
+	defer cleanup()
+
+	store := Store{Storage: &local.Storage{Root: dir}, Handles: handles}
+	refs := []upspin.Reference{}
+	for offset := 0; offset < len(content); offset += upspin.BlockSize {
+		refs = append(refs, upspin.Reference("big-"+strconv.Itoa(offset)))
+	}
+
+	b.SetBytes(int64(len(content)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for _, ref := range refs {
+			if _, _, _, err := store.Get(ref); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkSequentialGets(b *testing.B) {
+	benchmarkSequentialGets(b, nil)
+}
+
+func BenchmarkSequentialGetsWithHandles(b *testing.B) {
+	benchmarkSequentialGets(b, NewHandles(64))
+}
+
+// BenchmarkSmallGets reads small files, whose blocks are much smaller
+// than the buffers they are read into.
+func BenchmarkSmallGets(b *testing.B) {
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+	require.NoError(b, ioutil.WriteFile(filepath.Join(dir, "small"), []byte("hello world!\n"), 0644))
+
+	store := Store{Storage: &local.Storage{Root: dir}, Handles: NewHandles(64)}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, _, _, err := store.Get("small-0"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkIndexedGets reads a file block after block through an
+// Index, as the server does with -index, the versions of the files
+// being known without touching the disk.
+func benchmarkIndexedGets(b *testing.B, handles *Handles) {
+	dir, content, cleanup := newBigFile(b, 8)
+	defer cleanup()
+
+	index := &local.Index{Files: &local.Storage{Root: dir}}
+	require.NoError(b, index.Build())
+
+	store := Store{Storage: index, Handles: handles}
+	refs := []upspin.Reference{}
+	for offset := 0; offset < len(content); offset += upspin.BlockSize {
+		refs = append(refs, upspin.Reference("big-"+strconv.Itoa(offset)))
+	}
+
+	b.SetBytes(int64(len(content)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for _, ref := range refs {
+			if _, _, _, err := store.Get(ref); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkIndexedGets(b *testing.B) {
+	benchmarkIndexedGets(b, nil)
+}
+
+func BenchmarkIndexedGetsWithHandles(b *testing.B) {
+	benchmarkIndexedGets(b, NewHandles(64))
+}
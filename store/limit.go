@@ -0,0 +1,199 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"upspin.io/upspin"
+)
+
+// The reasons given to Limiter.OnThrottle.
+const (
+	ThrottledRequests    = "requests"
+	ThrottledBytes       = "bytes"
+	ThrottledConcurrency = "concurrency"
+)
+
+// maxIdleBuckets is the number of users above which the buckets of the
+// idle ones are dropped.
+const maxIdleBuckets = 10000
+
+// Limiter limits the rate of the requests and of the bytes read of each
+// user with token buckets, and the number of reads running at once. The
+// zero values disable the limits.
+type Limiter struct {
+	// Requests is the number of requests per second of each user, up to
+	// RequestBurst at once.
+	Requests     float64
+	RequestBurst int
+
+	// Bytes is the number of bytes per second read for each user, up to
+	// ByteBurst at once. As the size of a block is only known once read,
+	// a user may exceed it by one block before being throttled.
+	Bytes     float64
+	ByteBurst int
+
+	// Concurrency is the number of reads running at once for all the
+	// users, reads ahead included.
+	Concurrency int
+
+	// OnThrottle, if set, is called with the reason of every request
+	// refused.
+	OnThrottle func(user upspin.UserName, reason string)
+
+	mu      sync.Mutex
+	users   map[upspin.UserName]*userBuckets
+	running int
+
+	// now is time.Now, replaced in tests.
+	now func() time.Time
+}
+
+type userBuckets struct {
+	requests bucket
+	bytes    bucket
+}
+
+// bucket is a token bucket, refilled at rate tokens per second up to
+// burst. Its tokens may go below zero, the debt being paid back before
+// anything else is allowed.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) refill(now time.Time, rate float64, burst int) {
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+	}
+	b.last = now
+}
+
+// Acquire reserves a read for user. It returns the reason of the limit
+// exceeded, if any, or a function to call with the number of bytes read
+// once done.
+func (l *Limiter) Acquire(user upspin.UserName) (release func(n int), reason string) {
+	if l == nil {
+		return func(int) {}, ""
+	}
+
+	l.mu.Lock()
+	reason = l.acquireLocked(user)
+	l.mu.Unlock()
+
+	if reason != "" {
+		if l.OnThrottle != nil {
+			l.OnThrottle(user, reason)
+		}
+		return nil, reason
+	}
+
+	return func(n int) { l.release(user, n) }, ""
+}
+
+// TryAcquire reserves a read done for user without them requesting it,
+// such as a read ahead. It takes one of the reads running at once and the
+// bytes read are charged to user, but it is not counted as a request and
+// being refused is not reported to OnThrottle.
+func (l *Limiter) TryAcquire(user upspin.UserName) (release func(n int), ok bool) {
+	if l == nil {
+		return func(int) {}, true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.Bytes > 0 {
+		b := l.buckets(user)
+		b.bytes.refill(l.clock(), l.Bytes, l.ByteBurst)
+		if b.bytes.tokens <= 0 {
+			return nil, false
+		}
+	}
+	if l.Concurrency > 0 && l.running >= l.Concurrency {
+		return nil, false
+	}
+	l.running++
+
+	return func(n int) { l.release(user, n) }, true
+}
+
+func (l *Limiter) acquireLocked(user upspin.UserName) string {
+	now := l.clock()
+	b := l.buckets(user)
+
+	if l.Requests > 0 {
+		b.requests.refill(now, l.Requests, l.RequestBurst)
+		if b.requests.tokens < 1 {
+			return ThrottledRequests
+		}
+	}
+	if l.Bytes > 0 {
+		b.bytes.refill(now, l.Bytes, l.ByteBurst)
+		if b.bytes.tokens <= 0 {
+			return ThrottledBytes
+		}
+	}
+	if l.Concurrency > 0 && l.running >= l.Concurrency {
+		return ThrottledConcurrency
+	}
+
+	if l.Requests > 0 {
+		b.requests.tokens--
+	}
+	l.running++
+
+	return ""
+}
+
+func (l *Limiter) release(user upspin.UserName, n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.running--
+	if l.Bytes > 0 {
+		b := l.buckets(user)
+		b.bytes.refill(l.clock(), l.Bytes, l.ByteBurst)
+		b.bytes.tokens -= float64(n)
+	}
+}
+
+// buckets returns the buckets of user, dropping those of the idle users
+// if there are too many.
+func (l *Limiter) buckets(user upspin.UserName) *userBuckets {
+	if l.users == nil {
+		l.users = map[upspin.UserName]*userBuckets{}
+	}
+
+	b, ok := l.users[user]
+	if ok {
+		return b
+	}
+
+	if len(l.users) >= maxIdleBuckets {
+		now := l.clock()
+		for u, ub := range l.users {
+			ub.requests.refill(now, l.Requests, l.RequestBurst)
+			ub.bytes.refill(now, l.Bytes, l.ByteBurst)
+			if ub.requests.tokens >= float64(l.RequestBurst) && ub.bytes.tokens >= float64(l.ByteBurst) {
+				delete(l.users, u)
+			}
+		}
+	}
+
+	b = &userBuckets{}
+	l.users[user] = b
+	return b
+}
+
+func (l *Limiter) clock() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
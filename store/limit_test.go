@@ -0,0 +1,193 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gildasch/upspin-localserver/local"
+	"github.com/gildasch/upspin-localserver/packing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func TestLimiterRequests(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	throttled := []string{}
+	l := &Limiter{
+		Requests:     2,
+		RequestBurst: 2,
+		OnThrottle: func(user upspin.UserName, reason string) {
+			throttled = append(throttled, string(user)+" "+reason)
+		},
+		now: clock.now,
+	}
+
+	for i := 0; i < 2; i++ {
+		release, reason := l.Acquire("a@example.com")
+		require.Equal(t, "", reason)
+		release(0)
+	}
+	_, reason := l.Acquire("a@example.com")
+	assert.Equal(t, ThrottledRequests, reason)
+
+	// Other users have their own bucket.
+	release, reason := l.Acquire("b@example.com")
+	require.Equal(t, "", reason)
+	release(0)
+
+	clock.t = clock.t.Add(500 * time.Millisecond)
+	release, reason = l.Acquire("a@example.com")
+	require.Equal(t, "", reason)
+	release(0)
+	_, reason = l.Acquire("a@example.com")
+	assert.Equal(t, ThrottledRequests, reason)
+
+	assert.Equal(t, []string{"a@example.com requests", "a@example.com requests"}, throttled)
+}
+
+func TestLimiterBytes(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	l := &Limiter{
+		Bytes:     100,
+		ByteBurst: 150,
+		now:       clock.now,
+	}
+
+	release, reason := l.Acquire("a@example.com")
+	require.Equal(t, "", reason)
+	release(200)
+
+	_, reason = l.Acquire("a@example.com")
+	assert.Equal(t, ThrottledBytes, reason)
+
+	// The debt of 50 bytes is paid back in half a second.
+	clock.t = clock.t.Add(400 * time.Millisecond)
+	_, reason = l.Acquire("a@example.com")
+	assert.Equal(t, ThrottledBytes, reason)
+
+	clock.t = clock.t.Add(200 * time.Millisecond)
+	release, reason = l.Acquire("a@example.com")
+	require.Equal(t, "", reason)
+	release(0)
+}
+
+func TestLimiterConcurrency(t *testing.T) {
+	l := &Limiter{Concurrency: 2}
+
+	release1, reason := l.Acquire("a@example.com")
+	require.Equal(t, "", reason)
+	release2, reason := l.Acquire("b@example.com")
+	require.Equal(t, "", reason)
+
+	_, reason = l.Acquire("c@example.com")
+	assert.Equal(t, ThrottledConcurrency, reason)
+
+	release1(10)
+	release3, reason := l.Acquire("c@example.com")
+	require.Equal(t, "", reason)
+	release2(10)
+	release3(10)
+}
+
+func TestNilLimiterAllowsEverything(t *testing.T) {
+	var l *Limiter
+
+	release, reason := l.Acquire("a@example.com")
+	require.Equal(t, "", reason)
+	release(upspin.BlockSize)
+}
+
+func TestGetThrottledReturnsTransient(t *testing.T) {
+	store := Store{
+		Root:    "../dir/test_data",
+		Limiter: &Limiter{Requests: 1, RequestBurst: 1},
+	}
+
+	_, _, _, err := store.Get("abc-0")
+	require.NoError(t, err)
+
+	_, _, _, err = store.Get("abc-0")
+	assert.True(t, errors.Is(errors.Transient, err))
+}
+
+func TestLimiterTryAcquire(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	throttled := 0
+	l := &Limiter{
+		Requests:     1,
+		RequestBurst: 1,
+		Bytes:        100,
+		ByteBurst:    150,
+		Concurrency:  1,
+		OnThrottle:   func(upspin.UserName, string) { throttled++ },
+		now:          clock.now,
+	}
+
+	// Reads ahead take a slot and are charged to the user, but are not
+	// requests.
+	release, ok := l.TryAcquire("a@example.com")
+	require.True(t, ok)
+	_, ok = l.TryAcquire("b@example.com")
+	assert.False(t, ok)
+	release(200)
+
+	_, reason := l.Acquire("a@example.com")
+	assert.Equal(t, ThrottledBytes, reason)
+	_, ok = l.TryAcquire("a@example.com")
+	assert.False(t, ok)
+	assert.Equal(t, 1, throttled)
+
+	release, reason = l.Acquire("b@example.com")
+	require.Equal(t, "", reason)
+	release(0)
+}
+
+func TestReadAheadRespectsLimits(t *testing.T) {
+	dir, _, cleanup := newBigFile(t, 8)
+	defer cleanup()
+
+	get := func(store *Store) {
+		for i := 0; i < 3; i++ {
+			ref := packing.Ref("big", int64(i)*upspin.BlockSize, upspin.BlockSize)
+			_, _, _, err := store.Get(ref)
+			require.NoError(t, err)
+		}
+	}
+
+	// The Get being served holds the only read allowed at once.
+	store := &Store{
+		Storage: &local.Storage{Root: dir},
+		Blocks:  NewBlockCache(64<<20, 4),
+		Limiter: &Limiter{Concurrency: 1},
+	}
+	get(store)
+	_, _, prefetched := store.Blocks.Stats()
+	assert.Equal(t, uint64(0), prefetched)
+
+	// The blocks read in advance are charged to the user.
+	limiter := &Limiter{Bytes: 1, ByteBurst: 6 * upspin.BlockSize}
+	store = &Store{
+		Storage: &local.Storage{Root: dir},
+		Blocks:  NewBlockCache(64<<20, 4),
+		Limiter: limiter,
+	}
+	get(store)
+	assert.Eventually(t, func() bool {
+		_, _, prefetched := store.Blocks.Stats()
+		return prefetched > 0
+	}, time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool {
+		_, ok := limiter.TryAcquire("")
+		return !ok
+	}, time.Second, time.Millisecond)
+}
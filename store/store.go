@@ -1,88 +1,335 @@
 package store
 
 import (
-	"fmt"
+	"crypto/sha256"
 	"io"
-	"os"
+	"log/slog"
 	"path"
-	"strconv"
-	"strings"
+	"sync"
+	"time"
 
+	"github.com/gildasch/upspin-localserver/audit"
+	"github.com/gildasch/upspin-localserver/local"
+	"github.com/gildasch/upspin-localserver/logging"
+	"github.com/gildasch/upspin-localserver/packing"
+	"upspin.io/access"
 	"upspin.io/errors"
 	"upspin.io/upspin"
 )
 
+type Storage interface {
+	Open(name string) (local.File, error)
+}
+
+// Policy decides who can read the files served. A nil Policy lets
+// everyone read everything.
+type Policy interface {
+	Can(requester upspin.UserName, right access.Right, name string) (bool, error)
+}
+
+// Auditor records the accesses to the blocks served.
+type Auditor interface {
+	Record(e audit.Entry) error
+}
+
+// blockPool holds the buffers the blocks of upspin.BlockSize or less are
+// read into.
+var blockPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, upspin.BlockSize)
+		return &buf
+	},
+}
+
 type Store struct {
 	upspin.StoreServer
 
-	Root  string
-	Debug bool
+	// Username is the owner of the files served, whose tree the paths
+	// recorded in the audit log are in.
+	Username string
+	Root     string
+
+	// Storage is where the blocks are read from. If nil, the files are
+	// read directly under Root.
+	Storage Storage
+	Policy  Policy
+
+	// Logger receives a record of every call. If nil, nothing is
+	// logged.
+	Logger *slog.Logger
+
+	// Audit, if set, records every Get.
+	Audit Auditor
+
+	// Limiter, if set, throttles the Gets.
+	Limiter *Limiter
+
+	// Handles, if set, keeps the files open between Gets.
+	Handles *Handles
+
+	// Blocks, if set, keeps the blocks read in memory and reads the
+	// next blocks of the files read sequentially in advance.
+	Blocks *BlockCache
+
+	// Chunks finds the content of the chunks referenced by their hash.
+	// If nil, only fixed-size blocks are served.
+	Chunks *packing.ChunkIndex
+
+	// userName is the name of the user on behalf of whom this
+	// server is serving.
+	userName upspin.UserName
 }
 
 func (s *Store) Dial(config upspin.Config, endpoint upspin.Endpoint) (upspin.Service, error) {
-	if s.Debug {
-		fmt.Printf("dir.Dial called with config=%#v, endpoint=%#v\n", config, endpoint)
+	cp := *s // copy of the generator instance.
+	if config != nil {
+		cp.userName = config.UserName()
 	}
 
-	return s, nil
+	return &cp, nil
 }
 
 func (s *Store) Endpoint() upspin.Endpoint {
-	if s.Debug {
-		fmt.Printf("store.Endpoint called\n")
-	}
-
 	return upspin.Endpoint{}
 }
 
 func (s *Store) Close() {
-	if s.Debug {
-		fmt.Printf("store.Close called\n")
+}
+
+func (s *Store) split(ref string) (relativePath string, offset, blockSize int64, err error) {
+	return packing.ParseRef(upspin.Reference(ref))
+}
+
+func (s *Store) Get(ref upspin.Reference) ([]byte, *upspin.Refdata, []upspin.Location, error) {
+	const op errors.Op = "store.Get"
+
+	start := time.Now()
+	data, name, err := s.get(ref)
+	s.logCall(op, ref, len(data), start, err)
+	s.record(op, ref, name, len(data), err)
+	if err != nil {
+		return nil, nil, nil, err
 	}
+
+	return data, &upspin.Refdata{Reference: ref}, nil, nil
 }
 
-func (s *Store) split(ref string) (relativePath string, offset int64, err error) {
-	split := strings.Split(ref, "-")
+// get returns the block ref and the name of the file it is read from, if
+// known.
+func (s *Store) get(ref upspin.Reference) (block []byte, name string, err error) {
+	if ref == upspin.HTTPBaseMetadata {
+		return nil, "", errors.E(errors.NotExist)
+	}
+
+	var locations []packing.BlockLocation
+	sum, chunk := packing.ParseChunkRef(ref)
+	if chunk {
+		locations = s.Chunks.Locate(sum)
+	} else {
+		relativePath, offset, blockSize, err := s.split(string(ref))
+		// The references hold the size of their block, up to
+		// packing.MaxBlockSize, so that the entries listed with any
+		// block size resolve.
+		if err != nil {
+			return nil, "", errors.E(errors.NotExist)
+		}
+		name = relativePath
+		locations = []packing.BlockLocation{{Filename: relativePath, Offset: offset, Size: blockSize}}
+	}
 
-	offset, err = strconv.ParseInt(split[len(split)-1], 10, 64)
+	locations, err = s.allowed(locations)
 	if err != nil {
-		return
+		if chunk {
+			// Telling that the content is in files the user can't read
+			// would let them probe for any content.
+			err = errors.E(errors.NotExist)
+		}
+		return nil, name, err
 	}
 
-	relativePath = strings.Join(
-		split[:len(split)-1], "-")
+	release, reason := s.Limiter.Acquire(s.userName)
+	if reason != "" {
+		return nil, name, errors.E(errors.Transient,
+			errors.Errorf("too many %s, retry later", reason))
+	}
 
-	return
+	for _, l := range locations {
+		if !chunk {
+			block, err = s.readBlock(l)
+			break
+		}
+		// The read ahead of Blocks follows fixed-size blocks, not the
+		// chunks, which are read directly.
+		block, err = s.read(l.Filename, l.Offset, l.Size)
+		// The file may have changed since it was chunked.
+		if err == nil && sha256.Sum256(block) == sum {
+			name = l.Filename
+			break
+		}
+		block, err = nil, errors.E(errors.NotExist)
+	}
+	release(len(block))
+	if err != nil {
+		return nil, name, err
+	}
+
+	return block, name, nil
 }
 
-func (s *Store) Get(ref upspin.Reference) ([]byte, *upspin.Refdata, []upspin.Location, error) {
-	if s.Debug {
-		fmt.Printf("store.Get called with ref=%#v\n", ref)
+// allowed returns the locations the user can read. It fails if there
+// are none.
+func (s *Store) allowed(locations []packing.BlockLocation) ([]packing.BlockLocation, error) {
+	if len(locations) == 0 {
+		return nil, errors.E(errors.NotExist)
+	}
+	if s.Policy == nil {
+		return locations, nil
 	}
 
-	if ref == upspin.HTTPBaseMetadata {
-		return nil, nil, nil, errors.E(errors.NotExist)
+	var allowed []packing.BlockLocation
+	var err error
+	for _, l := range locations {
+		ok, perr := s.Policy.Can(s.userName, access.Read, l.Filename)
+		switch {
+		case perr != nil:
+			err = errors.E(errors.NotExist)
+		case !ok:
+			if err == nil {
+				err = errors.E(errors.Permission)
+			}
+		default:
+			allowed = append(allowed, l)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, err
 	}
 
-	relativePath, offset, err := s.split(string(ref))
-	if err != nil {
-		return nil, nil, nil, errors.E(errors.NotExist)
+	return allowed, nil
+}
+
+// readBlock reads the block at l, through Blocks if set.
+func (s *Store) readBlock(l packing.BlockLocation) ([]byte, error) {
+	if s.Blocks != nil {
+		return s.Blocks.Read(s.storage(), l.Filename, l.Offset, l.Size, s.read, s.acquireAhead)
 	}
+	return s.read(l.Filename, l.Offset, l.Size)
+}
 
-	f, err := os.Open(path.Join(s.Root, relativePath))
+// read reads the block of size bytes of the file name at offset.
+func (s *Store) read(name string, offset, size int64) ([]byte, error) {
+	f, done, err := s.open(name)
 	if err != nil {
-		return nil, nil, nil, errors.E(errors.NotExist)
+		return nil, errors.E(errors.NotExist)
 	}
 
-	bytes := make([]byte, upspin.BlockSize)
-	n, err := f.ReadAt(bytes, offset)
+	// Blocks bigger than the pooled buffers are allocated, only up to
+	// the end of the file.
+	if size > upspin.BlockSize {
+		if fi, err := f.Stat(); err == nil && fi.Size()-offset < size {
+			size = fi.Size() - offset
+			if size < 0 {
+				size = 0
+			}
+		}
+	}
+
+	var buf []byte
+	if size <= upspin.BlockSize {
+		pooled := blockPool.Get().(*[]byte)
+		defer blockPool.Put(pooled)
+		buf = (*pooled)[:size]
+	} else {
+		buf = make([]byte, size)
+	}
+
+	n, err := f.ReadAt(buf, offset)
+	done()
 	if err != nil && err != io.EOF {
-		return nil, nil, nil, errors.E(errors.IO)
+		return nil, errors.E(errors.IO)
+	}
+
+	// The block is kept by the caller, so it can't be the pooled buffer.
+	// Copying it only allocates the size of the block read, which is
+	// usually much less than the size of the block asked for.
+	block := make([]byte, n)
+	copy(block, buf[:n])
+
+	return block, nil
+}
+
+// acquireAhead reserves a read ahead for the user, if their limits leave
+// room for it. The bytes read are charged to the user.
+func (s *Store) acquireAhead() (release func(n int), ok bool) {
+	return s.Limiter.TryAcquire(s.userName)
+}
+
+// open returns the file name and a function to call once done with it.
+func (s *Store) open(name string) (local.File, func(), error) {
+	if s.Handles != nil {
+		return s.Handles.Open(s.storage(), name)
+	}
+	return openOnce(s.storage(), name)
+}
+
+// logCall logs the call to op on ref, started at start, that returned n
+// bytes or err.
+func (s *Store) logCall(op errors.Op, ref upspin.Reference, n int, start time.Time, err error) {
+	logger := s.Logger
+	if logger == nil {
+		return
 	}
 
-	if s.Debug {
-		fmt.Printf("store.Get returning byte array of lenght %d starting with %#v\n", len(bytes), bytes[:20])
+	attrs := []any{
+		"user", s.userName,
+		"method", op,
+		"ref", ref,
+		"bytes", n,
+		"duration", time.Since(start),
+	}
+	if err == nil {
+		logger.Debug("call", attrs...)
+		return
+	}
+
+	attrs = append(attrs, "kind", logging.ErrorKind(err), "error", err)
+	if errors.Is(errors.IO, err) {
+		logger.Error("call failed", attrs...)
+		return
+	}
+	logger.Info("call failed", attrs...)
+}
+
+// record adds the call to op on ref of the file name that returned n
+// bytes or err to the audit log.
+func (s *Store) record(op errors.Op, ref upspin.Reference, name string, n int, err error) {
+	if s.Audit == nil {
+		return
+	}
+
+	e := audit.Entry{
+		User:     s.userName,
+		Op:       string(op),
+		Ref:      ref,
+		Bytes:    n,
+		Decision: audit.Decision(err),
+	}
+	if name != "" {
+		e.Path = upspin.PathName(s.Username + path.Clean("/"+name))
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	if err := s.Audit.Record(e); err != nil && s.Logger != nil {
+		s.Logger.Error("could not record access", "error", err)
+	}
+}
+
+func (s *Store) storage() Storage {
+	if s.Storage != nil {
+		return s.Storage
 	}
 
-	return bytes[:n], &upspin.Refdata{Reference: ref}, nil, nil
+	return &local.Storage{Root: s.Root}
 }
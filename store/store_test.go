@@ -1,16 +1,29 @@
 package store
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 
+	"github.com/gildasch/upspin-localserver/audit"
+	"github.com/gildasch/upspin-localserver/local"
+	"github.com/gildasch/upspin-localserver/packing"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"upspin.io/access"
+	"upspin.io/config"
+	"upspin.io/errors"
 	"upspin.io/upspin"
 )
 
 func TestDial(t *testing.T) {
-	store := Store{
-		Debug: false,
-	}
+	store := Store{}
 
 	actual, err := store.Dial(nil, upspin.Endpoint{})
 
@@ -19,9 +32,7 @@ func TestDial(t *testing.T) {
 }
 
 func TestEndpoint(t *testing.T) {
-	store := Store{
-		Debug: false,
-	}
+	store := Store{}
 
 	actual := store.Endpoint()
 
@@ -29,17 +40,14 @@ func TestEndpoint(t *testing.T) {
 }
 
 func TestClose(t *testing.T) {
-	store := Store{
-		Debug: false,
-	}
+	store := Store{}
 
 	store.Close()
 }
 
 func TestGetOK(t *testing.T) {
 	store := Store{
-		Root:  "../dir/test_data",
-		Debug: false,
+		Root: "../dir/test_data",
 	}
 
 	b, r, l, err := store.Get("abc-0")
@@ -53,6 +61,66 @@ func TestGetOK(t *testing.T) {
 	assert.Equal(t, []upspin.Location(nil), l)
 }
 
+func TestGetLogsCalls(t *testing.T) {
+	var buf bytes.Buffer
+	store := Store{
+		Root:   "../dir/test_data",
+		Logger: slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	}
+
+	_, _, _, err := store.Get("abc-0")
+	require.NoError(t, err)
+	_, _, _, err = store.Get("missingfile-0")
+	require.Error(t, err)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], "level=DEBUG msg=call")
+	assert.Contains(t, lines[0], "method=store.Get ref=abc-0 bytes=13")
+	assert.Contains(t, lines[1], "level=INFO msg=\"call failed\"")
+	assert.Contains(t, lines[1], "ref=missingfile-0")
+}
+
+type MockAuditor struct {
+	entries []audit.Entry
+}
+
+func (ma *MockAuditor) Record(e audit.Entry) error {
+	ma.entries = append(ma.entries, e)
+	return nil
+}
+
+func TestGetRecordsAccesses(t *testing.T) {
+	auditor := &MockAuditor{}
+	generator := &Store{
+		Username: "owner@example.com",
+		Root:     "../dir/test_data",
+		Audit:    auditor,
+	}
+	service, err := generator.Dial(config.SetUserName(config.New(), "reader@example.com"), upspin.Endpoint{})
+	require.NoError(t, err)
+	store := service.(*Store)
+
+	_, _, _, err = store.Get("abc-0")
+	require.NoError(t, err)
+	_, _, _, err = store.Get("missingfile-0")
+	require.Error(t, err)
+
+	require.Len(t, auditor.entries, 2)
+	assert.Equal(t, audit.Entry{
+		User:     "reader@example.com",
+		Op:       "store.Get",
+		Ref:      "abc-0",
+		Path:     "owner@example.com/abc",
+		Bytes:    13,
+		Decision: audit.Allowed,
+	}, auditor.entries[0])
+	assert.Equal(t, upspin.Reference("missingfile-0"), auditor.entries[1].Ref)
+	assert.Equal(t, upspin.PathName("owner@example.com/missingfile"), auditor.entries[1].Path)
+	assert.Equal(t, audit.Failed, auditor.entries[1].Decision)
+	assert.NotEmpty(t, auditor.entries[1].Error)
+}
+
 func TestGetHTTPBaseMetadataReturnsNotExist(t *testing.T) {
 	_, _, _, err := (&Store{}).Get(upspin.HTTPBaseMetadata)
 
@@ -73,8 +141,7 @@ func TestGetErrorOpeningFileReturnsNotExist(t *testing.T) {
 
 func TestGetUnreadableFileReturnsIOError(t *testing.T) {
 	store := Store{
-		Root:  "../dir/test_data",
-		Debug: false,
+		Root: "../dir/test_data",
 	}
 
 	_, _, _, err := store.Get(".-1048576")
@@ -82,25 +149,162 @@ func TestGetUnreadableFileReturnsIOError(t *testing.T) {
 	assert.EqualError(t, err, "I/O error")
 }
 
+type MockPolicy struct {
+	allowed bool
+}
+
+func (mp *MockPolicy) Can(requester upspin.UserName, right access.Right, name string) (bool, error) {
+	return mp.allowed, nil
+}
+
+func TestGetDeniedByPolicyReturnsPermission(t *testing.T) {
+	store := Store{
+		Root:   "../dir/test_data",
+		Policy: &MockPolicy{allowed: false},
+	}
+
+	_, _, _, err := store.Get("abc-0")
+
+	assert.EqualError(t, err, "permission denied")
+
+	store.Policy = &MockPolicy{allowed: true}
+	_, _, _, err = store.Get("abc-0")
+
+	assert.NoError(t, err)
+}
+
 func TestSplit(t *testing.T) {
 	cases := map[string]struct {
 		relativePath string
 		offset       int64
+		blockSize    int64
 	}{
-		"filename.ext-0":                {"filename.ext", 0},
-		"/in/subfolder/filename.ext-0":  {"/in/subfolder/filename.ext", 0},
-		"/dir/filename-with-dash.ext-0": {"/dir/filename-with-dash.ext", 0},
+		"filename.ext-0":                     {"filename.ext", 0, upspin.BlockSize},
+		"/in/subfolder/filename.ext-0":       {"/in/subfolder/filename.ext", 0, upspin.BlockSize},
+		"/dir/filename-with-dash.ext-0":      {"/dir/filename-with-dash.ext", 0, upspin.BlockSize},
+		"/dir/filename-with-dash.ext-8:4":    {"/dir/filename-with-dash.ext", 8, 4},
+		"/dir/filename:with-colon.ext-0:512": {"/dir/filename:with-colon.ext", 0, 512},
 	}
 
 	store := Store{
-		Root:  "../dir/test_data",
-		Debug: false,
+		Root: "../dir/test_data",
 	}
 
 	for in, expected := range cases {
-		actualRelative, actualOffset, err := store.split(in)
+		actualRelative, actualOffset, actualBlockSize, err := store.split(in)
 		assert.NoError(t, err)
 		assert.Equal(t, expected.relativePath, actualRelative)
 		assert.Equal(t, expected.offset, actualOffset)
+		assert.Equal(t, expected.blockSize, actualBlockSize)
+	}
+}
+
+func TestGetBlockSizeFromRef(t *testing.T) {
+	store := Store{
+		Root: "../dir/test_data",
 	}
+
+	b, r, _, err := store.Get("abc-6:5")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("world"), b)
+	assert.Equal(t, &upspin.Refdata{Reference: "abc-6:5"}, r)
+
+	_, _, _, err = store.Get("abc-0:0")
+	assert.Error(t, err)
+
+	// Blocks of any size are served, whatever the size the entries are
+	// listed in now.
+	b, _, _, err = store.Get("abc-0:4096")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello world!\n"), b)
+
+	b, _, _, err = store.Get("abc-0")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello world!\n"), b)
+}
+
+func TestGetOversizedRefIsRefused(t *testing.T) {
+	store := Store{
+		Root: "../dir/test_data",
+	}
+
+	_, _, _, err := store.Get("abc-0:16777217")
+	assert.Error(t, err)
+
+	// Big blocks are only allocated up to the end of the file.
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b, _, _, err := store.Get("abc-0:16777216")
+	runtime.ReadMemStats(&after)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello world!\n"), b)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(8<<20))
+}
+
+func TestGetChunk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 10000)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), content, 0644))
+
+	storage := &local.Storage{Root: dir}
+	chunks := packing.NewChunkIndex(storage, packing.NewChunker(16<<10))
+	fi, err := storage.Stat("file")
+	require.NoError(t, err)
+	cs, err := chunks.Chunk(fi)
+	require.NoError(t, err)
+	require.NotEmpty(t, cs)
+
+	auditor := &MockAuditor{}
+	store := Store{
+		Username: "owner@example.com",
+		Storage:  storage,
+		Chunks:   chunks,
+		Blocks:   NewBlockCache(1<<20, 1),
+		Audit:    auditor,
+	}
+
+	read := []byte{}
+	for _, c := range cs {
+		b, r, _, err := store.Get(packing.ChunkRef(c.Sum))
+		require.NoError(t, err)
+		assert.Equal(t, &upspin.Refdata{Reference: packing.ChunkRef(c.Sum)}, r)
+		read = append(read, b...)
+	}
+	assert.Equal(t, content, read)
+
+	// Chunks are not read ahead as fixed-size blocks.
+	hits, misses, prefetched := store.Blocks.Stats()
+	assert.Zero(t, hits+misses+prefetched)
+	assert.Zero(t, store.Blocks.Bytes())
+
+	// The accesses are recorded with the file the chunks were read from.
+	require.Len(t, auditor.entries, len(cs))
+	assert.Equal(t, upspin.PathName("owner@example.com/file"), auditor.entries[0].Path)
+	store.Audit = nil
+
+	_, _, _, unknown := store.Get(packing.ChunkRef(sha256.Sum256([]byte("unknown"))))
+	assert.Error(t, unknown)
+
+	// Content only in files the user can't read is not told apart from
+	// unknown content.
+	store.Policy = &MockPolicy{allowed: false}
+	_, _, _, err = store.Get(packing.ChunkRef(cs[0].Sum))
+	assert.Error(t, err)
+	assert.Equal(t, unknown.Error(), err.Error())
+	assert.True(t, errors.Is(errors.NotExist, err))
+	store.Policy = nil
+
+	// A chunk whose content changed since the file was chunked is not
+	// served.
+	store.Blocks = nil
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), bytes.ToUpper(content), 0644))
+	_, _, _, err = store.Get(packing.ChunkRef(cs[0].Sum))
+	assert.Error(t, err)
+
+	// Chunk references are unknown without a chunk index.
+	_, _, _, err = (&Store{Storage: storage}).Get(packing.ChunkRef(cs[0].Sum))
+	assert.Error(t, err)
 }
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// certReloader serves the certificate of CertFile and KeyFile, reloaded
+// when the files change or Reload is called. The connections already
+// established keep the certificate they were opened with.
+type certReloader struct {
+	CertFile string
+	KeyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	watcher *fsnotify.Watcher
+}
+
+// Reload loads the certificate from the files, keeping the current one
+// if they are invalid.
+func (r *certReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return errors.Wrapf(err, "could not load certificate %q", r.CertFile)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.cert == nil {
+		return nil, errors.New("no certificate loaded")
+	}
+	return r.cert, nil
+}
+
+// Watch reloads the certificate when the files change. The directories
+// of the files are watched, so that files replaced by a rename are seen.
+func (r *certReloader) Watch() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "could not watch certificate")
+	}
+	for _, dir := range []string{filepath.Dir(r.CertFile), filepath.Dir(r.KeyFile)} {
+		if err := w.Add(dir); err != nil {
+			w.Close()
+			return errors.Wrapf(err, "could not watch %q", dir)
+		}
+	}
+
+	r.mu.Lock()
+	r.watcher = w
+	r.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != filepath.Clean(r.CertFile) &&
+					filepath.Clean(event.Name) != filepath.Clean(r.KeyFile) {
+					continue
+				}
+				// The certificate and the key are often replaced one
+				// after the other, fail silently until both match.
+				if err := r.Reload(); err == nil {
+					logger.Info("reloaded certificate", "cert", r.CertFile)
+				}
+			case _, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Close stops watching the files.
+func (r *certReloader) Close() error {
+	r.mu.Lock()
+	w := r.watcher
+	r.watcher = nil
+	r.mu.Unlock()
+
+	if w == nil {
+		return nil
+	}
+	return w.Close()
+}
+
+// selfSigned writes to dir a certificate for hosts signed by a local CA,
+// creating the CA in dir the first time. Clients must trust the ca.pem
+// file of dir. It returns the names of the certificate and key files.
+func selfSigned(dir string, hosts []string) (certFile, keyFile string, err error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", errors.Wrap(err, "could not create the certificates directory")
+	}
+
+	ca, caKey, err := loadCA(dir)
+	if os.IsNotExist(errors.Cause(err)) {
+		ca, caKey, err = createCA(dir)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", errors.Wrap(err, "could not generate key")
+	}
+
+	template, err := certTemplate(hosts[0], 90*24*time.Hour)
+	if err != nil {
+		return "", "", err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return "", "", errors.Wrap(err, "could not create certificate")
+	}
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := writeKey(keyFile, key); err != nil {
+		return "", "", err
+	}
+	if err := writeCert(certFile, der); err != nil {
+		return "", "", err
+	}
+
+	return certFile, keyFile, nil
+}
+
+func loadCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		if _, serr := os.Stat(filepath.Join(dir, "ca.pem")); os.IsNotExist(serr) {
+			return nil, nil, serr
+		}
+		return nil, nil, errors.Wrap(err, "could not load the CA")
+	}
+
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not parse the CA")
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("the key of the CA is not an ECDSA key")
+	}
+
+	return ca, key, nil
+}
+
+func createCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not generate the CA key")
+	}
+
+	template, err := certTemplate("upspin-localserver CA", 10*365*24*time.Hour)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage |= x509.KeyUsageCertSign
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not create the CA")
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not parse the CA")
+	}
+
+	if err := writeKey(filepath.Join(dir, "ca-key.pem"), key); err != nil {
+		return nil, nil, err
+	}
+	if err := writeCert(filepath.Join(dir, "ca.pem"), der); err != nil {
+		return nil, nil, err
+	}
+
+	return ca, key, nil
+}
+
+func certTemplate(name string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not generate serial number")
+	}
+
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, nil
+}
+
+func writeCert(name string, der []byte) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(name, data, 0644); err != nil {
+		return errors.Wrapf(err, "could not write %q", name)
+	}
+	return nil
+}
+
+func writeKey(name string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal key")
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(name, data, 0600); err != nil {
+		return errors.Wrapf(err, "could not write %q", name)
+	}
+	return nil
+}
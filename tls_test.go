@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func verifySelfSigned(t *testing.T, dir, certFile, keyFile, host string) *tls.Certificate {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	require.NoError(t, err)
+
+	caPEM, err := ioutil.ReadFile(filepath.Join(dir, "ca.pem"))
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(caPEM))
+
+	_, err = cert.Verify(x509.VerifyOptions{DNSName: host, Roots: roots})
+	assert.NoError(t, err)
+
+	return &pair
+}
+
+func TestSelfSigned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, err := selfSigned(dir, []string{"localhost", "127.0.0.1"})
+	require.NoError(t, err)
+	verifySelfSigned(t, dir, certFile, keyFile, "localhost")
+	verifySelfSigned(t, dir, certFile, keyFile, "127.0.0.1")
+
+	ca, err := ioutil.ReadFile(filepath.Join(dir, "ca.pem"))
+	require.NoError(t, err)
+
+	// The CA is kept when the certificate is generated again.
+	certFile, keyFile, err = selfSigned(dir, []string{"usl.example.com"})
+	require.NoError(t, err)
+	verifySelfSigned(t, dir, certFile, keyFile, "usl.example.com")
+
+	again, err := ioutil.ReadFile(filepath.Join(dir, "ca.pem"))
+	require.NoError(t, err)
+	assert.Equal(t, ca, again)
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, err := selfSigned(dir, []string{"first.example.com"})
+	require.NoError(t, err)
+
+	r := &certReloader{CertFile: certFile, KeyFile: keyFile}
+	_, err = r.GetCertificate(nil)
+	assert.Error(t, err)
+
+	require.NoError(t, r.Reload())
+	require.NoError(t, r.Watch())
+	defer r.Close()
+
+	first, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+
+	// Invalid files keep the current certificate.
+	require.NoError(t, ioutil.WriteFile(certFile, []byte("garbage"), 0644))
+	assert.Error(t, r.Reload())
+	current, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, first, current)
+
+	_, _, err = selfSigned(dir, []string{"second.example.com"})
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		current, err := r.GetCertificate(nil)
+		if err != nil {
+			return false
+		}
+		leaf, err := x509.ParseCertificate(current.Certificate[0])
+		return err == nil && leaf.Subject.CommonName == "second.example.com"
+	}, 2*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,120 @@
+package unixperm
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/gildasch/upspin-localserver/local"
+	"github.com/pkg/errors"
+	"upspin.io/access"
+	"upspin.io/upspin"
+)
+
+const accessFile = "Access"
+
+type Storage interface {
+	Open(name string) (local.File, error)
+	Stat(name string) (local.FileInfo, error)
+}
+
+// Policy decides who can access the files of Storage. The rules of the
+// closest Access file apply if there is one. Otherwise, the files and
+// directories readable by anyone on the host, along with all their
+// parents, are readable and listable by all upspin users, and the other
+// ones only by Owner.
+type Policy struct {
+	Owner   upspin.UserName
+	Storage Storage
+}
+
+// Can reports whether requester has the right on the file name.
+func (p *Policy) Can(requester upspin.UserName, right access.Right, name string) (bool, error) {
+	if requester == p.Owner {
+		return true, nil
+	}
+
+	clean := path.Clean("/" + name)
+
+	acc, err := p.closestAccess(clean)
+	if err != nil {
+		return false, err
+	}
+	if acc != nil {
+		return acc.Can(requester, right, p.pathName(clean), p.loadGroup)
+	}
+
+	switch right {
+	case access.Read, access.List, access.AnyRight:
+	default:
+		return false, nil
+	}
+
+	for d := clean; ; d = path.Dir(d) {
+		fi, err := p.Storage.Stat(d)
+		if err != nil {
+			return false, err
+		}
+		if !worldReadable(fi) {
+			return false, nil
+		}
+		if d == "/" {
+			break
+		}
+	}
+
+	return true, nil
+}
+
+// closestAccess returns the parsed Access file of name if it is a
+// directory, or of its closest parent directory holding one, or nil if
+// there is none.
+func (p *Policy) closestAccess(name string) (*access.Access, error) {
+	for d := name; ; d = path.Dir(d) {
+		accessName := path.Join(d, accessFile)
+		data, err := p.read(accessName)
+		if err == nil {
+			acc, err := access.Parse(p.pathName(accessName), data)
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not parse %q", accessName)
+			}
+			return acc, nil
+		}
+		if d == "/" {
+			return nil, nil
+		}
+	}
+}
+
+func (p *Policy) loadGroup(name upspin.PathName) ([]byte, error) {
+	prefix := string(p.Owner) + "/"
+	if !strings.HasPrefix(string(name), prefix) {
+		return nil, errors.Errorf("group file %q is not served here", name)
+	}
+
+	return p.read(strings.TrimPrefix(string(name), string(p.Owner)))
+}
+
+func (p *Policy) read(name string) ([]byte, error) {
+	f, err := p.Storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
+
+func (p *Policy) pathName(name string) upspin.PathName {
+	return upspin.PathName(string(p.Owner) + name)
+}
+
+// worldReadable reports whether anyone on the host can read fi, and
+// also traverse it in the case of a directory.
+func worldReadable(fi local.FileInfo) bool {
+	perm := fi.Mode.Perm()
+	if fi.IsDir {
+		return perm&0005 == 0005
+	}
+	return perm&0004 != 0
+}
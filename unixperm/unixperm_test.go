@@ -0,0 +1,114 @@
+package unixperm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gildasch/upspin-localserver/local"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"upspin.io/access"
+	"upspin.io/upspin"
+)
+
+const owner = upspin.UserName("owner@example.com")
+
+// writeFiles creates the files and directories, by name relative to
+// root, with their mode. The root is readable by everyone.
+func writeFiles(t *testing.T, root string, files map[string]os.FileMode) {
+	require.NoError(t, os.Chmod(root, 0755))
+
+	for name, mode := range files {
+		p := filepath.Join(root, name)
+		if mode.IsDir() {
+			require.NoError(t, os.MkdirAll(p, 0755))
+		} else {
+			require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+			require.NoError(t, ioutil.WriteFile(p, nil, 0644))
+		}
+		require.NoError(t, os.Chmod(p, mode.Perm()))
+	}
+}
+
+func TestCanFromPermissionBits(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]os.FileMode{
+		"public.txt":         0644,
+		"private.txt":        0600,
+		"closed":             os.ModeDir | 0700,
+		"closed/public.txt":  0644,
+		"shared":             os.ModeDir | 0755,
+		"shared/private.txt": 0640,
+	})
+	policy := &Policy{
+		Owner:   owner,
+		Storage: &local.Storage{Root: root},
+	}
+
+	cases := map[string]bool{
+		"public.txt":         true,
+		"private.txt":        false,
+		"closed":             false,
+		"closed/public.txt":  false,
+		"shared":             true,
+		"shared/private.txt": false,
+		"/":                  true,
+	}
+
+	for name, expected := range cases {
+		ok, err := policy.Can("someone@example.com", access.Read, name)
+		assert.NoError(t, err, name)
+		assert.Equal(t, expected, ok, name)
+
+		ok, err = policy.Can(owner, access.Read, name)
+		assert.NoError(t, err, name)
+		assert.True(t, ok, name)
+	}
+
+	ok, err := policy.Can("someone@example.com", access.Write, "public.txt")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestCanFromAccessFile(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]os.FileMode{
+		"private.txt":        0600,
+		"shared":             os.ModeDir | 0700,
+		"shared/private.txt": 0600,
+	})
+	policy := &Policy{
+		Owner:   owner,
+		Storage: &local.Storage{Root: root},
+	}
+
+	require.NoError(t, ioutil.WriteFile(
+		filepath.Join(root, "shared", "Access"),
+		[]byte("r,l: friend@example.com\n"), 0600))
+
+	ok, err := policy.Can("friend@example.com", access.Read, "shared/private.txt")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = policy.Can("someone@example.com", access.Read, "shared/private.txt")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = policy.Can("friend@example.com", access.Read, "private.txt")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestCanUnknownFile(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]os.FileMode{})
+	policy := &Policy{
+		Owner:   owner,
+		Storage: &local.Storage{Root: root},
+	}
+
+	_, err := policy.Can("someone@example.com", access.Read, "unknown.txt")
+	assert.Error(t, err)
+}